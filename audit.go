@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SettingsSpec is the Finder appearance folders are expected to have, for
+// audit. Its keys are those ExportSettings uses; settings left out of the
+// spec are not checked.
+type SettingsSpec struct {
+	ViewStyle     *string     `json:"viewStyle"`
+	IconSize      *int        `json:"iconSize"`
+	ArrangeBy     *string     `json:"arrangeBy"`
+	LabelPosition *string     `json:"labelPosition"`
+	Background    *Background `json:"background"`
+}
+
+// readSettingsSpec decodes a spec, rejecting unknown keys so a misspelt
+// setting is not silently left unchecked.
+func readSettingsSpec(r io.Reader) (SettingsSpec, error) {
+	var spec SettingsSpec
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return SettingsSpec{}, fmt.Errorf("reading settings spec: %w", err)
+	}
+	return spec, nil
+}
+
+// SettingsDeviation is a setting of a folder that differs from the spec.
+// Got is "(not set)" when the store does not record the setting.
+type SettingsDeviation struct {
+	Setting string
+	Want    string
+	Got     string
+}
+
+// notSet is the Got of a setting the store does not record.
+const notSet = "(not set)"
+
+// Audit compares the folder's own settings, those of the "." record, with
+// spec, and returns the settings that differ in spec order. A store
+// without a "." record has none of the settings.
+func (d *DSStore) Audit(spec SettingsSpec) []SettingsDeviation {
+	var v ViewSettings
+	if r, ok := d.Record("."); ok {
+		v = r.ViewSettings()
+	}
+	var deviations []SettingsDeviation
+	check := func(setting, want, got string, has bool) {
+		if !has {
+			got = notSet
+		}
+		if !strings.EqualFold(want, got) {
+			deviations = append(deviations, SettingsDeviation{Setting: setting, Want: want, Got: got})
+		}
+	}
+	if spec.ViewStyle != nil {
+		check("viewStyle", *spec.ViewStyle, string(v.Style), v.HasStyle)
+	}
+	if spec.IconSize != nil {
+		check("iconSize", strconv.Itoa(*spec.IconSize), strconv.Itoa(v.IconSize), v.HasIconView)
+	}
+	if spec.ArrangeBy != nil {
+		check("arrangeBy", *spec.ArrangeBy, v.ArrangeBy, v.HasIconView)
+	}
+	if spec.LabelPosition != nil {
+		check("labelPosition", *spec.LabelPosition, v.LabelPosition, v.LabelPosition != "")
+	}
+	if spec.Background != nil {
+		check("background", spec.Background.Type, v.Background, v.HasBackground)
+		if spec.Background.Color != "" && v.HasBackground && v.Background == "ClrB" {
+			c := v.BackgroundColor
+			check("background color", spec.Background.Color, fmt.Sprintf("#%04x%04x%04x", c[0], c[1], c[2]), true)
+		}
+	}
+	return deviations
+}
+
+// writeAudit prints one line per deviation of the store at filename from
+// spec and returns how many there were.
+func writeAudit(w io.Writer, filename string, ds *DSStore, spec SettingsSpec) int {
+	deviations := ds.Audit(spec)
+	for _, dev := range deviations {
+		fmt.Fprintf(w, "%s: %s is %s, expected %s\n", filename, dev.Setting, dev.Got, dev.Want)
+	}
+	return len(deviations)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ANSI SGR codes used by the human-readable renderer.
+const (
+	sgrBold   = "1"
+	sgrCyan   = "36"
+	sgrYellow = "33"
+)
+
+func colorize(code, s string) string {
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// colorLine highlights the label of a "Label: value" line, leaving the
+// value and any leading indentation untouched.
+func colorLine(line string) string {
+	trimmed := strings.TrimLeft(line, "\t ")
+	indent := line[:len(line)-len(trimmed)]
+	if i := strings.Index(trimmed, ": "); i > 0 {
+		return indent + colorize(sgrCyan, trimmed[:i+1]) + trimmed[i+1:]
+	}
+	if strings.HasSuffix(trimmed, ":") {
+		return indent + colorize(sgrCyan, trimmed)
+	}
+	return line
+}
+
+// isTerminal reports whether f is a character device, i.e. an interactive
+// terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorEnabled resolves a --color mode for output going to f. "auto" honors
+// the NO_COLOR convention.
+func colorEnabled(mode string, f *os.File) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+	}
+}
@@ -2,36 +2,160 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"image"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 	"unicode/utf16"
+	"unicode/utf8"
 	"howett.net/plist"
+	"golang.org/x/text/unicode/norm"
 )
 
-// The Python code uses a lot of warnings and yields.
-// We'll just print warnings to stderr for simplicity.
-func warn(msg string) {
-	fmt.Fprintln(os.Stderr, "Warning:", msg)
-}
 
 // show_date: In Python code, it converts a 1904-based timestamp.
 // In Python:
 //   date = datetime.datetime(1904,1,1) + (timestamp since 1904)
 // The DS_Store uses Mac epoch starting in 1904. We'll replicate that logic.
 func showDate(timestamp float64) string {
-	// Mac epoch (1904-01-01)
-	macEpoch := time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
-	date := macEpoch.Add(time.Duration(timestamp) * time.Second)
+	date := macEpochTime(timestamp)
 	// Format similar to Python code: '%B %-d, %Y at %-I:%M %p'
 	// In Go we can do: "January 2, 2006 at 3:04 PM"
 	return date.Format("January 2, 2006 at 3:04 PM")
 }
 
+// macEpochTime converts whole seconds since the Mac epoch (1904-01-01 UTC)
+// to a time.Time. Fractions of a second are dropped.
+func macEpochTime(timestamp float64) time.Time {
+	macEpoch := time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return macEpoch.Add(time.Duration(timestamp) * time.Second)
+}
+
+// renderOptions holds presentation choices for the human-readable output.
+// They are set once by main before any rendering happens.
+type renderOptions struct {
+	// bytesEncoding is how raw, undecoded byte fields are printed:
+	// "hex" (the default) or "base64".
+	bytesEncoding string
+	// color enables ANSI colors for record names and field labels.
+	color bool
+	// rawPlists prints list view property lists as generic plist dumps
+	// instead of laying out their columns as a table.
+	rawPlists bool
+	// hexInts prints integer field values in hexadecimal.
+	hexInts bool
+	// volume is the mount point that put-back locations (ptbL) are resolved
+	// against, or "" to print them as stored.
+	volume string
+	// offsets annotates each field with where its value is stored, offset
+	// by offsetBase, the position of the store within its file.
+	offsets    bool
+	offsetBase int
+	// indent is printed once per nesting level in front of each line of
+	// text output: a tab by default, or spaces.
+	indent string
+}
+
+var render = renderOptions{bytesEncoding: "hex", indent: "\t"}
+
+// indentLine prefixes line, which carries its own nesting as leading tabs,
+// with level more levels of render.indent.
+func indentLine(line string, level int) string {
+	trimmed := strings.TrimLeft(line, "\t")
+	level += len(line) - len(trimmed)
+	return strings.Repeat(render.indent, level) + trimmed
+}
+
+// showInt renders an integer field value in decimal, or in hex when
+// hexInts is set. Other values are printed as %v would.
+func showInt(data interface{}) string {
+	if render.hexInts {
+		switch v := data.(type) {
+		case int:
+			return fmt.Sprintf("%#x", v)
+		case int64:
+			return fmt.Sprintf("%#x", v)
+		}
+	}
+	return fmt.Sprint(data)
+}
+
+// encodeBytes renders raw bytes using the configured encoding.
+func encodeBytes(data []byte) string {
+	if render.bytesEncoding == "base64" {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return fmt.Sprintf("0x%s", hex.EncodeToString(data))
+}
+
+// macDateSeconds decodes a Mac timestamp into seconds since 1904. Integer
+// values (the dutc and comp types) and 8-byte blobs count 1/65536 seconds;
+// 4-byte blobs hold whole seconds, like classic HFS dates. Blobs are
+// little-endian for some reason, though some stores have them big-endian,
+// see blobDateOrder. Other widths, 2 bytes included, have no known date
+// encoding and report false.
+func macDateSeconds(data interface{}) (float64, bool) {
+	switch v := data.(type) {
+	case int:
+		return float64(v) / 65536.0, true
+	case int64:
+		return float64(v) / 65536.0, true
+	case []byte:
+		order, _ := blobDateOrder(v)
+		return blobDateSeconds(v, order)
+	}
+	return 0, false
+}
+
+func blobDateSeconds(b []byte, order binary.ByteOrder) (float64, bool) {
+	switch len(b) {
+	case 4:
+		return float64(order.Uint32(b)), true
+	case 8:
+		return float64(order.Uint64(b)) / 65536.0, true
+	}
+	return 0, false
+}
+
+// Dates outside these years are taken as misread: the first Macs shipped
+// in 1984.
+var plausibleDates = [2]time.Time{
+	time.Date(1984, time.January, 1, 0, 0, 0, 0, time.UTC),
+	time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func plausibleDate(seconds float64) bool {
+	t := macEpochTime(seconds)
+	return !t.Before(plausibleDates[0]) && t.Before(plausibleDates[1])
+}
+
+// blobDateOrder picks the byte order of a date blob: little-endian unless
+// only the big-endian reading gives a plausible date. ambiguous is set when
+// both readings are plausible and differ, leaving little-endian a guess.
+func blobDateOrder(b []byte) (order binary.ByteOrder, ambiguous bool) {
+	little, ok := blobDateSeconds(b, binary.LittleEndian)
+	if !ok {
+		return binary.LittleEndian, false
+	}
+	big, _ := blobDateSeconds(b, binary.BigEndian)
+	switch okLittle, okBig := plausibleDate(little), plausibleDate(big); {
+	case okBig && !okLittle:
+		return binary.BigEndian, false
+	case okBig && okLittle && big != little:
+		return binary.LittleEndian, true
+	}
+	return binary.LittleEndian, false
+}
+
 func isDecimal(b []byte) bool {
 	for _, c := range b {
 		if c < '0' || c > '9' {
@@ -46,37 +170,29 @@ func showBytes(data []byte) string {
 		var val interface{}
 		decoder := plist.NewDecoder(bytes.NewReader(data))
 		if err := decoder.Decode(&val); err != nil {
-			// If plist decoding fails, just return hex
-			return fmt.Sprintf("0x%s", hex.EncodeToString(data))
+			// If plist decoding fails, just return the raw bytes
+			return encodeBytes(data)
 		}
 		return strings.Join(show(val, 0), "\n")
 	} else if len(data) >= 4 && bytes.HasPrefix(data, []byte("book")) {
 		// macOS alias type (unparsed)
 		return fmt.Sprintf("(in macOS alias type, unparsed) %q", data)
 	} else if len(data) >= 4 && bytes.HasPrefix(data, []byte("Bud1")) {
-		// The python code tries to parse a DSStore from data.
-		// We'll just note this as unparsed.
-		embedded := []byte{0x00, 0x00, 0x00, 0x01}
-		embedded = append(embedded, data...)
-		ds := NewDSStore(embedded)
-		if err := ds.Parse(); err == nil {
-			var lines []string
-			for _, r := range ds.records {
-				lines = append(lines, r.humanReadable()...)
-			}
-			return strings.Join(lines, "\n")
-		}
-		// If parsing fails, just return hex
-		return fmt.Sprintf("0x%s", hex.EncodeToString(data))
+		// Stores Parse expanded are rendered by embeddedLines instead.
+		return fmt.Sprintf("(embedded DS_Store, %d bytes, not expanded)", len(data))
 	} else {
-		return fmt.Sprintf("0x%s", hex.EncodeToString(data))
+		return encodeBytes(data)
 	}
 }
 
 func isInline(data interface{}) bool {
-	switch data.(type) {
-	case string, bool, int, int64, float64, []byte:
+	switch v := data.(type) {
+	case string, bool, int, int64, uint64, float64, []byte:
 		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
 	default:
 		return false
 	}
@@ -96,7 +212,19 @@ func show(data interface{}, tabDepth int) []string {
 
 	switch v := data.(type) {
 	case map[string]interface{}:
-		for key, value := range v {
+		if len(v) == 0 {
+			// Say so, or an empty plist root leaves its label dangling.
+			result = append(result, tabs+"(empty dictionary)")
+			break
+		}
+		// Sort keys so output is stable; Go maps don't keep the plist's order.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := v[key]
 			if isInline(value) {
 				result = append(result, fmt.Sprintf("%s%s: %s", tabs, key, showOne(value)))
 			} else {
@@ -105,6 +233,11 @@ func show(data interface{}, tabDepth int) []string {
 			}
 		}
 	case []interface{}:
+		if len(v) == 0 {
+			result = append(result, tabs+"(empty array)")
+			break
+		}
+		// Elements are listed as "- value", nested ones under a bare "-".
 		for _, value := range v {
 			if isInline(value) {
 				result = append(result, fmt.Sprintf("%s- %s", tabs, showOne(value)))
@@ -121,6 +254,9 @@ func show(data interface{}, tabDepth int) []string {
 		result = append(result, fmt.Sprintf("%s%d", tabs, v))
 	case int64:
 		result = append(result, fmt.Sprintf("%s%d", tabs, v))
+	case uint64:
+		// plist integers decode as uint64
+		result = append(result, fmt.Sprintf("%s%d", tabs, v))
 	case float64:
 		result = append(result, fmt.Sprintf("%s%f", tabs, v))
 	case string:
@@ -136,6 +272,30 @@ func show(data interface{}, tabDepth int) []string {
 type Record struct {
 	name   string
 	fields map[string]interface{}
+	// order lists the field codes in the order they were read from the
+	// tree, then those added since, so output follows the file.
+	order []string
+	// decoded caches Decode results per field; update drops stale entries.
+	decoded map[string]interface{}
+	// plistFormats records the format of each plist Decode parsed, see
+	// PlistFormat.
+	plistFormats map[string]string
+	// raw holds each field's value as it was encoded on disk, so it can be
+	// written back unchanged. update drops it, as the value may differ.
+	raw map[string]rawValue
+	// embedded holds the stores parsed from blob fields, see Embedded.
+	embedded map[string]*DSStore
+	// nested marks the records of an embedded store, whose offsets are
+	// not the file's.
+	nested bool
+}
+
+// rawValue is an encoded value: its four-char data type and payload.
+type rawValue struct {
+	data []byte
+	// offset is the position of data in the store's content, or -1 when
+	// it did not come from there.
+	offset int
 }
 
 func NewRecord(name string) *Record {
@@ -143,9 +303,99 @@ func NewRecord(name string) *Record {
 }
 
 func (r *Record) update(fields map[string]interface{}) {
+	var added []string
 	for k, v := range fields {
+		if _, ok := r.fields[k]; !ok {
+			added = append(added, k)
+		}
 		r.fields[k] = v
+		delete(r.decoded, k)
+		delete(r.plistFormats, k)
+		delete(r.raw, k)
+		delete(r.embedded, k)
+	}
+	// New fields from one call have no order of their own; sort them so
+	// output stays deterministic.
+	sort.Strings(added)
+	r.order = append(r.order, added...)
+}
+
+// setRaw sets field to value along with the encoding it was read from.
+func (r *Record) setRaw(field string, value interface{}, raw rawValue) {
+	r.update(map[string]interface{}{field: value})
+	if r.raw == nil {
+		r.raw = make(map[string]rawValue)
+	}
+	r.raw[field] = raw
+}
+
+// plistFields hold an embedded property list, binary or XML.
+var plistFields = map[string]bool{
+	"bwsp": true,
+	"icvp": true,
+	"lsvC": true,
+	"lsvP": true,
+	"lsvp": true,
+}
+
+// Decode returns the value of field with embedded property lists parsed.
+// Other values are returned as stored, unless a decoder registered with
+// RegisterFieldDecoder gives one. Parsed plists are cached, so rendering a
+// record in several formats decodes each plist once.
+func (r *Record) Decode(field string) interface{} {
+	if v, ok := r.decoded[field]; ok {
+		return v
+	}
+	if d := fieldDecoders[field]; d.value != nil {
+		if v := d.value(r, field); v != nil {
+			return v
+		}
+	}
+	b, ok := r.plistData(field)
+	if !ok {
+		return r.fields[field]
+	}
+	v, format := parsePlist(b)
+	if _, failed := v.([]byte); failed {
+		defer scopeWarnings(r.name, field)()
+		warn("bad-plist", -1, fmt.Sprintf("%s of %s is not a valid property list", field, r.name))
+	}
+	if r.decoded == nil {
+		r.decoded = make(map[string]interface{})
+		r.plistFormats = make(map[string]string)
+	}
+	r.decoded[field] = v
+	if format != "" {
+		r.plistFormats[field] = format
+	}
+	return v
+}
+
+// PlistFormat returns how the embedded property list in field is stored:
+// "binary" (bplist00), "XML", "OpenStep" or "GNUstep". It returns "" when
+// the field holds no plist or it fails to parse.
+func (r *Record) PlistFormat(field string) string {
+	r.Decode(field)
+	return r.plistFormats[field]
+}
+
+// plistLabel is the heading for a plist field's lines, naming its format
+// when known, as in "Layout property list (binary plist):".
+func (r *Record) plistLabel(label, field string) string {
+	if format := r.PlistFormat(field); format != "" {
+		return fmt.Sprintf("%s (%s plist):", label, format)
 	}
+	return label + ":"
+}
+
+// plistData returns the raw bytes of field if it holds an embedded
+// property list: a known plist field, or any blob with the bplist magic.
+func (r *Record) plistData(field string) ([]byte, bool) {
+	b, ok := r.fields[field].([]byte)
+	if !ok || !(plistFields[field] || bytes.HasPrefix(b, []byte("bplist"))) {
+		return nil, false
+	}
+	return b, true
 }
 
 // Validate the type (we do best effort checks)
@@ -160,7 +410,7 @@ func (r *Record) validateType(field string, data interface{}, expected string, a
 				}
 			}
 			if !okLen {
-				warn(fmt.Sprintf("%v %s %s not of length %v", r, field, showOne(data), acceptableLengths))
+				warn("bad-length", -1, fmt.Sprintf("%v %s %s not of length %v", r, field, showOne(data), acceptableLengths))
 			}
 		}
 	}
@@ -169,24 +419,24 @@ func (r *Record) validateType(field string, data interface{}, expected string, a
 	case "bool":
 		_, ok := data.(bool)
 		if !ok {
-			warn(fmt.Sprintf("%v %s not bool", r, field))
+			warn("bad-type", -1, fmt.Sprintf("%v %s not bool", r, field))
 		}
 	case "int":
 		switch data.(type) {
 		case int, int64:
 			// ok
 		default:
-			warn(fmt.Sprintf("%v %s not int-like", r, field))
+			warn("bad-type", -1, fmt.Sprintf("%v %s not int-like", r, field))
 		}
 	case "str":
 		_, ok := data.(string)
 		if !ok {
-			warn(fmt.Sprintf("%v %s not string", r, field))
+			warn("bad-type", -1, fmt.Sprintf("%v %s not string", r, field))
 		}
 	case "bytes":
 		b, ok := data.([]byte)
 		if !ok {
-			warn(fmt.Sprintf("%v %s not []byte", r, field))
+			warn("bad-type", -1, fmt.Sprintf("%v %s not []byte", r, field))
 		} else {
 			checkLen(b)
 		}
@@ -195,509 +445,2285 @@ func (r *Record) validateType(field string, data interface{}, expected string, a
 	}
 }
 
-func (r *Record) String() string {
-	return fmt.Sprintf("Record(%q, %v)", r.name, r.fields)
+// IsDirectorySettings reports whether the record is the "." record, which
+// holds the settings of the directory containing the store rather than
+// describing one of its entries.
+func (r *Record) IsDirectorySettings() bool {
+	return r.name == "."
 }
 
-func (r *Record) humanReadable() []string {
-	var lines []string
-	for field, data := range r.fields {
-		// Match logic from Python code
-		switch field {
-		case "BKGD":
-			r.validateType(field, data, "bytes", 12)
-			b, _ := data.([]byte)
-			backgroundType := string(b[:4])
-			switch backgroundType {
-			case "DefB":
-				lines = append(lines, "Background: Default")
-			case "ClrB":
-				hexColor := hex.EncodeToString(b[4:10])
-				lines = append(lines, fmt.Sprintf("Background: Color #%s", hexColor))
-			case "PctB":
-				lines = append(lines, "Background: Picture, see \"Picture\" field")
-			default:
-				warn("Unrecognized background type " + backgroundType)
-				lines = append(lines, fmt.Sprintf("Background (unrecognized): %s", showOne(data)))
-			}
-		case "GRP0":
-			r.validateType(field, data, "str")
-			lines = append(lines, fmt.Sprintf("%s (unknown): %v", field, data))
-		case "ICVO":
-			r.validateType(field, data, "bool")
-			lines = append(lines, fmt.Sprintf("%s (unknown): %v", field, data))
-		case "Iloc":
-			r.validateType(field, data, "bytes", 16)
-			b := data.([]byte)
-			x := int(binary.BigEndian.Uint32(b[0:4]))
-			y := int(binary.BigEndian.Uint32(b[4:8]))
-			rest := b[8:16]
-			lines = append(lines, fmt.Sprintf("Icon location: x %dpx, y %dpx, %s", x, y, showOne(rest)))
-		case "LSVO":
-			r.validateType(field, data, "bool")
-			lines = append(lines, fmt.Sprintf("%s (unknown): %v", field, data))
-		case "bwsp":
-			r.validateType(field, data, "bytes")
-			val := parsePlist(data.([]byte))
-			lines = append(lines, "Layout property list:")
-			for _, l := range show(val, 1) {
-				lines = append(lines, l)
-			}
-		case "cmmt":
-			r.validateType(field, data, "str")
-			lines = append(lines, fmt.Sprintf("Comments: %v", data))
-		case "dilc":
-			r.validateType(field, data, "bytes", 32)
-			b := data.([]byte)
-			x := float64(int32(binary.BigEndian.Uint32(b[16:20]))) / 1000.0
-			y := float64(int32(binary.BigEndian.Uint32(b[20:24]))) / 1000.0
-			before := b[0:16]
-			after := b[24:32]
-			lines = append(lines, fmt.Sprintf("Icon location on desktop: x %.3f%%, y %.3f%%, %s, %s",
-				x, y, showOne(before), showOne(after)))
-		case "dscl":
-			r.validateType(field, data, "bool")
-			lines = append(lines, fmt.Sprintf("Open in list view: %v", data))
-		case "extn":
-			r.validateType(field, data, "str")
-			lines = append(lines, fmt.Sprintf("Extension: %v", data))
-		case "fwi0":
-			r.validateType(field, data, "bytes", 16)
-			b := data.([]byte)
-			top := int16(binary.BigEndian.Uint16(b[0:2]))
-			left := int16(binary.BigEndian.Uint16(b[2:4]))
-			bottom := int16(binary.BigEndian.Uint16(b[4:6]))
-			right := int16(binary.BigEndian.Uint16(b[6:8]))
-			lines = append(lines, "Finder window information:")
-			lines = append(lines, fmt.Sprintf("\tWindow rectangle: top %d, left %d, bottom %d, right %d",
-				top, left, bottom, right))
-			views := map[string]string{
-				"icnv": "Icon view",
-				"clmv": "Column view",
-				"Nlsv": "List view",
-				"Flwv": "Coverflow view",
-			}
-			viewRaw := string(b[8:12])
-			view, ok := views[viewRaw]
-			if !ok {
-				view = "(unrecognized) " + viewRaw
-			}
-			lines = append(lines, fmt.Sprintf("View style (might be overtaken): %s", view))
-			lines = append(lines, showOne(b[12:16]))
-		case "fwsw":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("Finder window sidebar width: %v", data))
-		case "fwvh":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("Finder window vertical height (overrides Finder window information): %v", data))
-		case "icgo":
-			r.validateType(field, data, "bytes", 8)
-			lines = append(lines, fmt.Sprintf("%s (unknown): %s", field, showOne(data)))
-		case "icsp":
-			r.validateType(field, data, "bytes", 8)
-			lines = append(lines, fmt.Sprintf("%s (unknown): %s", field, showOne(data)))
-		case "icvo":
-			r.validateType(field, data, "bytes")
-			b := data.([]byte)
-			lines = append(lines, "Icon view options:")
-			icvoType := string(b[0:4])
-			arranges := map[string]string{"none": "None", "grid": "Snap to Grid"}
-			labels := map[string]string{"botm": "Bottom", "rght": "Right"}
-			switch icvoType {
-			case "icvo":
-				if len(b) == 18 {
-					flags := b[4:12]
-					size := int(int16(binary.BigEndian.Uint16(b[12:14])))
-					arrangeRaw := string(b[14:18])
-					arrange := arranges[arrangeRaw]
-					if arrange == "" {
-						arrange = "(unknown) " + arrangeRaw
-					}
-					lines = append(lines, fmt.Sprintf("\tFlags (?): %s", showOne(flags)))
-					lines = append(lines, fmt.Sprintf("\tSize: %dpx", size))
-					lines = append(lines, fmt.Sprintf("\tKeep arranged by: %s", arrange))
-				} else {
-					warn("icvo data not length 18")
-					lines = append(lines, "\t(unrecognized icvo)")
-				}
-			case "icv4":
-				if len(b) == 26 {
-					size := int(int16(binary.BigEndian.Uint16(b[4:6])))
-					arrangeRaw := string(b[6:10])
-					arrange := arranges[arrangeRaw]
-					if arrange == "" {
-						arrange = "(unknown) " + arrangeRaw
-					}
-					labelRaw := string(b[10:14])
-					label := labels[labelRaw]
-					if label == "" {
-						label = "(unknown) " + labelRaw
-					}
-					flags := b[14:26]
-					info := (flags[1] & 0x01) != 0
-					preview := (flags[11] & 0x01) != 0
-					lines = append(lines, fmt.Sprintf("\tSize: %dpx", size))
-					lines = append(lines, fmt.Sprintf("\tKeep arranged by: %s", arrange))
-					lines = append(lines, fmt.Sprintf("\tLabel position: %s", label))
-					lines = append(lines, "\tFlags (partially known):")
-					lines = append(lines, fmt.Sprintf("\t\tRaw flags: %s", showOne(flags)))
-					lines = append(lines, fmt.Sprintf("\t\tShow item info: %v", info))
-					lines = append(lines, fmt.Sprintf("\t\tShow icon preview: %v", preview))
-				} else {
-					warn("icv4 data not length 26")
-					lines = append(lines, "\t(unrecognized icv4)")
-				}
-			default:
-				warn("Unrecognized icon view options type " + icvoType)
-				lines = append(lines, "\t(unrecognized): "+showOne(data))
-			}
-		case "icvp":
-			r.validateType(field, data, "bytes")
-			val := parsePlist(data.([]byte))
-			lines = append(lines, "Icon view property list:")
-			for _, l := range show(val, 1) {
-				lines = append(lines, l)
-			}
-		case "info":
-			r.validateType(field, data, "bytes")
-			lines = append(lines, fmt.Sprintf("%s (unknown): %s", field, showOne(data)))
-		case "logS", "lg1S":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("Logical size: %vB", data))
-		case "lssp":
-			r.validateType(field, data, "bytes", 8)
-			lines = append(lines, fmt.Sprintf("%s (unknown, List view scroll position?): %s", field, showOne(data)))
-		case "lsvC":
-			r.validateType(field, data, "bytes")
-			val := parsePlist(data.([]byte))
-			lines = append(lines, "List view properties, alternative:")
-			for _, l := range show(val, 1) {
-				lines = append(lines, l)
-			}
-		case "lsvP":
-			r.validateType(field, data, "bytes")
-			val := parsePlist(data.([]byte))
-			lines = append(lines, "List view properties, other alternative:")
-			for _, l := range show(val, 1) {
-				lines = append(lines, l)
-			}
-		case "lsvo":
-			r.validateType(field, data, "bytes", 76)
-			lines = append(lines, fmt.Sprintf("List view options (format unknown): %s", showOne(data)))
-		case "lsvp":
-			r.validateType(field, data, "bytes")
-			val := parsePlist(data.([]byte))
-			lines = append(lines, "List view properties:")
-			for _, l := range show(val, 1) {
-				lines = append(lines, l)
-			}
-		case "lsvt":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("List view text size: %vpt", data))
-		case "moDD", "modD":
-			// moDD and modD may be int or bytes
-			switch vv := data.(type) {
-			case int, int64:
-				// Date is number of 1/65536 seconds from 1904
-				var date float64
-				switch vi := vv.(type) {
-				case int:
-					date = float64(vi) / 65536.0
-				case int64:
-					date = float64(vi) / 65536.0
-				}
-				if field == "moDD" {
-					lines = append(lines, fmt.Sprintf("Modification date: %s", showDate(date)))
-				} else {
-					lines = append(lines, fmt.Sprintf("Modification date, alternative: %s", showDate(date)))
-				}
-			case []byte:
-				// Little endian for some reason
-				b := vv
-				var date uint64
-				switch len(b) {
-				case 2:
-					date = uint64(binary.LittleEndian.Uint16(b))
-				case 4:
-					date = uint64(binary.LittleEndian.Uint32(b))
-				case 8:
-					date = binary.LittleEndian.Uint64(b)
-				default:
-					// Just parse what we can
-					if len(b) <= 8 {
-						padded := make([]byte, 8)
-						copy(padded, b)
-						date = binary.LittleEndian.Uint64(padded)
-					} else {
-						// too long, just show raw
-						lines = append(lines, fmt.Sprintf("Modification date (timestamp, unknown): %s", hex.EncodeToString(b)))
-						break
-					}
-				}
-				if field == "moDD" {
-					lines = append(lines, fmt.Sprintf("Modification date (timestamp, format unknown): %d", date))
-				} else {
-					lines = append(lines, fmt.Sprintf("Modification date, alternative (timestamp, format unknown): %d", date))
-				}
-			}
-		case "ph1S", "phyS":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("Physical size: %vB", data))
-		case "pict":
-			// pict with BKGD
-			lines = append(lines, fmt.Sprintf("Picture: %s", showOne(data)))
-		case "vSrn":
-			r.validateType(field, data, "int")
-			lines = append(lines, fmt.Sprintf("%s (unknown): %v", field, data))
-		case "vstl":
-			r.validateType(field, data, "str")
-			views := map[string]string{
-				"icnv": "Icon view",
-				"clmv": "Column view",
-				"glyv": "Gallery view",
-				"Nlsv": "List view",
-				"Flwv": "Coverflow view",
-			}
-			strdata := data.(string)
-			view, ok := views[strdata]
-			if !ok {
-				view = "(unrecognized) " + strdata
-			}
-			lines = append(lines, fmt.Sprintf("View style: %s", view))
-		default:
-			lines = append(lines, fmt.Sprintf("%s (unrecognized): %v", field, data))
-		}
+// PutBackPath returns where a trashed item was before it was moved to the
+// Trash: its put-back location (ptbL) and name (ptbN, or the record name
+// if missing) joined under volume, which may be "" for a path relative to
+// the volume root. ok is false when ptbL is missing or not a plain string.
+func (r *Record) PutBackPath(volume string) (where string, ok bool) {
+	loc, ok := r.fields["ptbL"].(string)
+	if !ok {
+		return "", false
 	}
-	return lines
+	name, ok := r.fields["ptbN"].(string)
+	if !ok || name == "" {
+		name = r.name
+	}
+	return path.Join(volume, loc, name), true
 }
 
-// parsePlist attempts to parse a plist from a byte slice.
-func parsePlist(data []byte) interface{} {
-	decoder := plist.NewDecoder(bytes.NewReader(data))
-	var val interface{}
-	if err := decoder.Decode(&val); err != nil {
-		// return raw if fail
-		return data
+// directoryFields only ever appear on folders: they describe how Finder
+// displays a folder's contents.
+var directoryFields = []string{"icvp", "lsvp", "bwsp", "vstl", "fwi0"}
+
+// LooksLikeDirectory guesses whether the record is a folder, based on it
+// carrying folder-only view settings. It is a heuristic: a folder that was
+// never opened with custom settings has none of these fields and reports
+// false.
+func (r *Record) LooksLikeDirectory() bool {
+	for _, field := range directoryFields {
+		if _, ok := r.fields[field]; ok {
+			return true
+		}
 	}
-	return val
+	return false
 }
 
-// DSStore struct
-type DSStore struct {
-	content          []byte
-	cursor           int
-	records          []*Record
-	offsets          []uint32
-	allocatorOffset  uint32
-	allocatorLength  uint32
-	directory        map[string]uint32
-	masterID         uint32
-	freelist         map[uint32][]uint32
-	rootID           uint32
-	treeHeight       uint32
-	numRecords       uint32
-	numNodes         uint32
+// logicalSize returns the record's logS/lg1S value, or 0 if it has none.
+func (r *Record) logicalSize() int64 {
+	for _, field := range []string{"logS", "lg1S"} {
+		switch v := r.fields[field].(type) {
+		case int:
+			return int64(v)
+		case int64:
+			return v
+		}
+	}
+	return 0
 }
 
-func NewDSStore(content []byte) *DSStore {
-	return &DSStore{
-		content:  content,
-		records:  make([]*Record, 0),
-		directory: make(map[string]uint32),
-		freelist:  make(map[uint32][]uint32),
+// sortRecords orders records by key: "name", "fields" (field count) or
+// "size" (logical size). Ties keep their on-disk order.
+func sortRecords(records []*Record, key string, descending bool) error {
+	var less func(a, b *Record) bool
+	switch key {
+	case "name":
+		less = func(a, b *Record) bool { return a.name < b.name }
+	case "fields":
+		less = func(a, b *Record) bool { return len(a.fields) < len(b.fields) }
+	case "size":
+		less = func(a, b *Record) bool { return a.logicalSize() < b.logicalSize() }
+	default:
+		return fmt.Errorf("unknown sort key %q (want name, fields or size)", key)
 	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if descending {
+			return less(records[j], records[i])
+		}
+		return less(records[i], records[j])
+	})
+	return nil
 }
 
-func (d *DSStore) readRecords() []*Record {
-	return d.records
+func (r *Record) String() string {
+	return fmt.Sprintf("Record(%q, %v)", r.name, r.fields)
 }
 
-// read helpers
-func (d *DSStore) nextByte() byte {
-	b := d.content[d.cursor]
-	d.cursor++
-	return b
+func (r *Record) humanReadable() []string {
+	var lines []string
+	for _, field := range r.order {
+		fieldLines := r.fieldLinesIsolated(field, r.fields[field])
+		if at := r.provenance(field); at != "" && len(fieldLines) > 0 {
+			fieldLines[0] += " " + at
+		}
+		lines = append(lines, fieldLines...)
+	}
+	if line, ok := r.effectiveWindow(); ok {
+		lines = append(lines, line)
+	}
+	return lines
 }
 
-func (d *DSStore) nextBytes(n int) []byte {
-	b := d.content[d.cursor : d.cursor+n]
-	d.cursor += n
-	return b
+// DecodeField decodes one field outside of any store, as humanReadable
+// would within one. typeTag is its four-char data type and data the payload
+// stored after it, length prefix included for blob and ustr, as --format
+// raw prints them. It returns the value, with embedded property lists
+// parsed, and its rendered lines. The field is rendered as part of an
+// unnamed record, so decoding that depends on the filename, like extn's
+// comparison with the name's extension, sees none.
+func DecodeField(code, typeTag string, data []byte) (interface{}, []string, error) {
+	if len(code) != 4 || len(typeTag) != 4 {
+		return nil, nil, fmt.Errorf("field code %q and data type %q must both be four bytes", code, typeTag)
+	}
+	value, err := decodeRaw(append([]byte(typeTag), data...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", code, err)
+	}
+	r := NewRecord("")
+	r.update(map[string]interface{}{code: value})
+	return r.Decode(code), r.fieldLinesIsolated(code, value), nil
 }
 
-func (d *DSStore) nextUint32() uint32 {
-	b := d.nextBytes(4)
-	return binary.BigEndian.Uint32(b)
+// effectiveWindow consolidates the window fields of the "." record once
+// fwi0, fwsw and fwvh are all present: fwvh replaces the height of the
+// fwi0 rectangle, keeping its top edge, and fwsw gives the sidebar width.
+func (r *Record) effectiveWindow() (string, bool) {
+	height, okHeight := r.fields["fwvh"].(int)
+	sidebar, okSidebar := r.fields["fwsw"].(int)
+	v := r.ViewSettings()
+	if !r.IsDirectorySettings() || !v.HasWindow || !okHeight || !okSidebar {
+		return "", false
+	}
+	w := v.Window
+	return fmt.Sprintf("Effective window: top %d, left %d, bottom %d, right %d (%dx%d), sidebar %dpx",
+		w.Min.Y, w.Min.X, w.Min.Y+height, w.Max.X, w.Dx(), height, sidebar), true
 }
 
-func (d *DSStore) nextUint64() uint64 {
-	b := d.nextBytes(8)
-	return binary.BigEndian.Uint64(b)
+// fieldOffset locates a stored value, its data type included, in the file.
+type fieldOffset struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
 }
 
-func (d *DSStore) parseHeader() {
-	alignment := d.nextUint32()
-	if alignment != 0x00000001 {
-		warn(fmt.Sprintf("Alignment int %x not 0x00000001", alignment))
-	}
-	magic := d.nextUint32()
-	if magic != 0x42756431 {
-		warn(fmt.Sprintf("Magic bytes %x not 0x42756431 (Bud1)", magic))
-	}
-	d.allocatorOffset = 0x4 + d.nextUint32()
-	d.allocatorLength = d.nextUint32()
-	allocatorOffsetRepeat := 0x4 + d.nextUint32()
-	if allocatorOffsetRepeat != d.allocatorOffset {
-		warn(fmt.Sprintf("Allocator offsets %x and %x unequal", d.allocatorOffset, allocatorOffsetRepeat))
+// fieldOffset returns where field's value is stored when --offsets is set
+// and the value came from the top-level store, whose offsets are the
+// file's.
+func (r *Record) fieldOffset(field string) (fieldOffset, bool) {
+	raw, ok := r.raw[field]
+	if !render.offsets || r.nested || !ok || raw.offset < 0 {
+		return fieldOffset{}, false
 	}
+	return fieldOffset{Offset: render.offsetBase + raw.offset, Length: len(raw.data)}, true
 }
 
-func (d *DSStore) parseAllocator() {
-	d.cursor = int(d.allocatorOffset)
-	numOffsets := d.nextUint32()
-	second := d.nextUint32()
-	if second != 0 {
-		warn(fmt.Sprintf("Second int of allocator %x not 0x00000000", second))
-	}
-	d.offsets = make([]uint32, numOffsets)
-	for i := 0; i < int(numOffsets); i++ {
-		d.offsets[i] = d.nextUint32()
+// provenance renders fieldOffset as "@0x1a4+12", or "" without one.
+func (r *Record) provenance(field string) string {
+	at, ok := r.fieldOffset(field)
+	if !ok {
+		return ""
 	}
+	return fmt.Sprintf("@%#x+%d", at.Offset, at.Length)
+}
 
-	d.cursor = int(d.allocatorOffset) + 0x408
-	numKeys := d.nextUint32()
-	for i := 0; i < int(numKeys); i++ {
-		keyLength := int(d.nextByte())
-		keyBytes := d.nextBytes(keyLength)
-		key := string(keyBytes)
-		val := d.nextUint32()
-		d.directory[key] = val
-		if key != "DSDB" {
-			warn(fmt.Sprintf("Directory contains non-'DSDB' key %q and value %x", key, val))
+// fieldLinesIsolated renders one field, turning a panic in its decoder
+// (a short blob, a malformed plist, ...) into a single error line so the
+// record's other fields still render.
+func (r *Record) fieldLinesIsolated(field string, data interface{}) (lines []string) {
+	defer scopeWarnings(r.name, field)()
+	defer func() {
+		if e := recover(); e != nil {
+			warn("decode-error", -1, fmt.Sprintf("Could not decode %s of %s: %v", field, r.name, e))
+			lines = []string{fmt.Sprintf("(error decoding %s: %v)", field, e)}
 		}
+	}()
+	if nested := r.embedded[field]; nested != nil {
+		return embeddedLines(field, nested)
 	}
-	dsdbVal, ok := d.directory["DSDB"]
-	if !ok {
-		panic("Key 'DSDB' not found in table of contents")
-	}
-	d.masterID = dsdbVal
+	return r.fieldLines(field, data)
+}
 
-	for i := 0; i < 32; i++ {
-		valuesLength := d.nextUint32()
-		list := make([]uint32, valuesLength)
-		for j := 0; j < int(valuesLength); j++ {
-			list[j] = d.nextUint32()
+// embeddedLines renders the store nested in field as writeHumanReadable
+// would, one level deeper.
+func embeddedLines(field string, nested *DSStore) []string {
+	count := fmt.Sprintf("%d records", len(nested.records))
+	if len(nested.records) == 1 {
+		count = "1 record"
+	}
+	lines := []string{fmt.Sprintf("%s (embedded DS_Store, %s):", field, count)}
+	for _, r := range nested.records {
+		lines = append(lines, "\t"+r.name)
+		for _, line := range r.humanReadable() {
+			lines = append(lines, "\t\t"+line)
 		}
-		d.freelist[1<<i] = list
 	}
+	return lines
 }
 
-func (d *DSStore) parseTreeNode(nodeID uint32, master bool) {
-	offsetAndSize := d.offsets[nodeID]
-	d.cursor = 0x4 + int((offsetAndSize>>5)<<5)
-	// node size = 1 << (offsetAndSize & 0x1f) but we might not strictly need it
+// FieldDecoder decodes a field for display. typeTag is the field's
+// four-char data type and data its payload as stored, as DecodeField takes
+// them. It returns the field's rendered lines and its decoded value, or a
+// nil value to keep the generic decoding.
+type FieldDecoder func(typeTag string, data []byte) (lines []string, value interface{})
 
-	if master {
-		d.rootID = d.nextUint32()
-		d.treeHeight = d.nextUint32()
-		d.numRecords = d.nextUint32()
-		d.numNodes = d.nextUint32()
-		fifth := d.nextUint32()
-		if fifth != 0x00001000 {
-			warn(fmt.Sprintf("Fifth int of master %x not 0x00001000", fifth))
-		}
-		d.parseTreeNode(d.rootID, false)
-	} else {
-		nextID := d.nextUint32()
-		numRecords := d.nextUint32()
-		for i := 0; i < int(numRecords); i++ {
-			if nextID != 0 {
-				// Has children
-				childID := d.nextUint32()
-				currentCursor := d.cursor
-				d.parseTreeNode(childID, false)
-				d.cursor = currentCursor
+// fieldDecoder is a registered decoder. Built-in decoders render from the
+// record, for its name and cached plists, and the field's generic value;
+// value is only set for those registered with RegisterFieldDecoder.
+type fieldDecoder struct {
+	lines func(r *Record, field string, data interface{}) []string
+	value func(r *Record, field string) interface{}
+}
+
+// fieldDecoders maps field codes to their decoders. Fields without one are
+// reported as unrecognized.
+var fieldDecoders = make(map[string]fieldDecoder)
+
+func init() {
+	registerBuiltinDecoder(decodeBackground, "BKGD")
+	registerBuiltinDecoder(decodeBrowserSetting, "BROW", "bRsV")
+	registerBuiltinDecoder(decodeGRP0, "GRP0")
+	registerBuiltinDecoder(decodeIconViewOptionsSet, "ICVO")
+	registerBuiltinDecoder(decodeIconLocation, "Iloc")
+	registerBuiltinDecoder(decodeListViewOptionsSet, "LSVO")
+	registerBuiltinDecoder(decodeLayout, "bwsp")
+	registerBuiltinDecoder(decodeComments, "cmmt")
+	registerBuiltinDecoder(decodeDesktopIconLocation, "dilc")
+	registerBuiltinDecoder(decodeDisclosure, "dscl")
+	registerBuiltinDecoder(decodeExtension, "extn")
+	registerBuiltinDecoder(decodeWindowInfo, "fwi0")
+	registerBuiltinDecoder(decodeSidebarWidth, "fwsw")
+	registerBuiltinDecoder(decodeWindowHeight, "fwvh")
+	registerBuiltinDecoder(decodeUnknownBytes, "icgo")
+	registerBuiltinDecoder(decodeUnknownBytes, "icsp")
+	registerBuiltinDecoder(decodeIconViewOptions, "icvo")
+	registerBuiltinDecoder(decodeIconViewPlist, "icvp")
+	registerBuiltinDecoder(decodeIconTextSize, "icvt")
+	registerBuiltinDecoder(decodeInfo, "info")
+	registerBuiltinDecoder(decodeLogicalSize, "logS", "lg1S")
+	registerBuiltinDecoder(decodeListScrollPosition, "lssp")
+	registerBuiltinDecoder(decodeListViewColumnsAlt, "lsvC")
+	registerBuiltinDecoder(decodeListViewColumnsOther, "lsvP")
+	registerBuiltinDecoder(decodeListViewOptions, "lsvo")
+	registerBuiltinDecoder(decodeListViewColumns, "lsvp")
+	registerBuiltinDecoder(decodeListTextSize, "lsvt")
+	registerBuiltinDecoder(decodeModificationDate, "moDD", "modD")
+	registerBuiltinDecoder(decodeSettingsDate, "dutc")
+	registerBuiltinDecoder(decodePhysicalSize, "ph1S", "phyS")
+	registerBuiltinDecoder(decodePutBackLocation, "ptbL")
+	registerBuiltinDecoder(decodePutBackName, "ptbN")
+	registerBuiltinDecoder(decodePicture, "pict")
+	registerBuiltinDecoder(decodeVSrn, "vSrn")
+	registerBuiltinDecoder(decodeViewStyle, "vstl")
+}
+
+func registerBuiltinDecoder(fn func(r *Record, field string, data interface{}) []string, codes ...string) {
+	for _, code := range codes {
+		fieldDecoders[code] = fieldDecoder{lines: fn}
+	}
+}
+
+// RegisterFieldDecoder sets the decoder for a field code, replacing the
+// built-in one if there is any. Its lines are rendered in place of the
+// built-in ones and a non-nil value is what Decode, and so the JSON and
+// template output, give for the field. Register decoders before decoding
+// anything, e.g. from an init function; the registry is not locked.
+func RegisterFieldDecoder(code string, fn FieldDecoder) {
+	stored := func(r *Record, field string) (string, []byte, error) {
+		raw, ok := r.raw[field]
+		if !ok {
+			// Updated fields keep no encoding; encode the value.
+			data, err := encodeValue(r.fields[field])
+			if err != nil {
+				return "", nil, err
 			}
-			nameLength := d.nextUint32()
-			nameBytes := d.nextBytes(int(nameLength) * 2)
-			name := utf16ToString(nameBytes)
-			field := string(d.nextBytes(4))
-			dt := d.parseData()
-
-			// Update or create record
-			found := false
-			for _, rec := range d.records {
-				if rec.name == name {
-					rec.update(map[string]interface{}{field: dt})
-					found = true
-					break
-				}
+			raw = rawValue{data: data}
+		}
+		return string(raw.data[:4]), raw.data[4:], nil
+	}
+	fieldDecoders[code] = fieldDecoder{
+		lines: func(r *Record, field string, _ interface{}) []string {
+			typeTag, data, err := stored(r, field)
+			if err != nil {
+				warn("decode-error", -1, fmt.Sprintf("Could not decode %s of %s: %v", field, r.name, err))
+				return []string{fmt.Sprintf("(error decoding %s: %v)", field, err)}
 			}
-			if !found {
-				rec := NewRecord(name)
-				rec.update(map[string]interface{}{field: dt})
-				d.records = append(d.records, rec)
+			lines, _ := fn(typeTag, data)
+			return lines
+		},
+		value: func(r *Record, field string) interface{} {
+			typeTag, data, err := stored(r, field)
+			if err != nil {
+				return nil
 			}
-		}
-		if nextID != 0 {
-			d.parseTreeNode(nextID, false)
-		}
+			_, value := fn(typeTag, data)
+			return value
+		},
 	}
 }
 
-func (d *DSStore) parseData() interface{} {
-	dataType := string(d.nextBytes(4))
-	switch dataType {
-	case "bool":
-		b := d.nextByte()
-		return (b & 0x01) != 0
-	case "shor", "long":
-		// short also uses 4 bytes
-		val := d.nextUint32()
-		return int(val)
-	case "comp":
-		val := d.nextUint64()
-		return int64(val)
-	case "dutc":
-		// dutc is int 64
-		val := d.nextUint64()
-		return int64(val)
-	case "type":
-		tp := d.nextBytes(4)
-		return string(tp)
-	case "blob":
-		dataLength := d.nextUint32()
-		return d.nextBytes(int(dataLength))
-	case "ustr":
-		dataLength := d.nextUint32()
-		bytesData := d.nextBytes(int(dataLength * 2))
-		return utf16ToString(bytesData)
-	default:
-		log.Fatalf("Unrecognized data type %q", dataType)
-		return nil
+// fieldLines decodes a single field into human-readable lines, with the
+// decoder registered for its code.
+func (r *Record) fieldLines(field string, data interface{}) []string {
+	if d, ok := fieldDecoders[field]; ok {
+		return d.lines(r, field, data)
 	}
+	var lines []string
+	warn("unrecognized-field", -1, fmt.Sprintf("%v %s unrecognized", r, field))
+	lines = append(lines, fmt.Sprintf("%s (unrecognized): %s", field, showInt(data)))
+	return lines
 }
 
-func (d *DSStore) Parse() error {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Fprintln(os.Stderr, "Error parsing DS_Store:", r)
-		}
-	}()
-	d.parseHeader()
-	d.parseAllocator()
-	d.parseTreeNode(d.masterID, true)
-	return nil
+func decodeBackground(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 12)
+	b, _ := data.([]byte)
+	backgroundType := string(b[:4])
+	name, known := BackgroundTypes[backgroundType]
+	switch {
+	case backgroundType == "ClrB":
+		hexColor := hex.EncodeToString(b[4:10])
+		lines = append(lines, fmt.Sprintf("Background: %s #%s", name, hexColor))
+	case backgroundType == "PctB":
+		lines = append(lines, fmt.Sprintf("Background: %s, see \"Picture\" field", name))
+	case known:
+		lines = append(lines, "Background: "+name)
+	default:
+		warn("unknown-background", -1, "Unrecognized background type "+backgroundType)
+		lines = append(lines, fmt.Sprintf("Background (unrecognized): %s", showOne(data)))
+	}
+	return lines
 }
 
-func utf16ToString(b []byte) string {
-	if len(b)%2 != 0 {
-		return ""
+func decodeBrowserSetting(r *Record, field string, data interface{}) (lines []string) {
+	// BROW and bRsV turn up in newer stores beside the browser window and
+	// preview fields. Their meaning is not known, so only their data type
+	// is decoded: an embedded plist is parsed, anything else shown raw.
+	label := fmt.Sprintf("Browser/preview setting (%s, unknown)", field)
+	if raw, ok := r.raw[field]; ok {
+		label = fmt.Sprintf("Browser/preview setting (%s %s, unknown)", field, raw.data[:4])
 	}
-	u := make([]uint16, len(b)/2)
-	for i := 0; i < len(b); i += 2 {
-		u[i/2] = binary.BigEndian.Uint16(b[i : i+2])
+	if _, ok := r.plistData(field); ok {
+		lines = append(lines, r.plistLabel(label, field))
+		return append(lines, show(r.Decode(field), 1)...)
 	}
-	runes := utf16.Decode(u)
-	return string(runes)
+	switch data.(type) {
+	case int, int64:
+		return append(lines, fmt.Sprintf("%s: %s", label, showInt(data)))
+	}
+	return append(lines, fmt.Sprintf("%s: %s", label, showOne(data)))
+}
+
+func decodeGRP0(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "str")
+	lines = append(lines, fmt.Sprintf("%s (unknown): %v", field, data))
+	return lines
+}
+
+func decodeIconViewOptionsSet(r *Record, field string, data interface{}) (lines []string) {
+	// Set once the folder has its own icon view options (icvo/icvp)
+	// rather than the Finder defaults.
+	r.validateType(field, data, "bool")
+	lines = append(lines, fmt.Sprintf("Icon view options set (inferred): %v", data))
+	return lines
+}
+
+func decodeIconLocation(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 16)
+	b := data.([]byte)
+	x, y := ilocPosition(b)
+	rest := b[8:16]
+	order := "auto-arranged"
+	if index, ok := ilocIndex(b); ok {
+		order = fmt.Sprintf("manually ordered, index %d", index)
+	}
+	lines = append(lines, fmt.Sprintf("Icon location: x %dpx, y %dpx, %s (%s)", x, y, showOne(rest), order))
+	return lines
+}
+
+func decodeListViewOptionsSet(r *Record, field string, data interface{}) (lines []string) {
+	// The list view counterpart of ICVO, covering lsvo/lsvp.
+	r.validateType(field, data, "bool")
+	lines = append(lines, fmt.Sprintf("List view options set (inferred): %v", data))
+	return lines
+}
+
+func decodeLayout(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	val := r.Decode(field)
+	lines = append(lines, r.plistLabel("Layout property list", field))
+	for _, l := range show(val, 1) {
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func decodeComments(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "str")
+	lines = append(lines, fmt.Sprintf("Comments: %v", data))
+	return lines
+}
+
+func decodeDesktopIconLocation(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 32)
+	b := data.([]byte)
+	x := float64(int32(binary.BigEndian.Uint32(b[16:20]))) / 1000.0
+	y := float64(int32(binary.BigEndian.Uint32(b[20:24]))) / 1000.0
+	before := b[0:16]
+	after := b[24:32]
+	lines = append(lines, fmt.Sprintf("Icon location on desktop: x %.3f%%, y %.3f%%, %s, %s",
+		x, y, showOne(before), showOne(after)))
+	return lines
+}
+
+func decodeDisclosure(r *Record, field string, data interface{}) (lines []string) {
+	// Normally a bool, but some stores hold it as a long 0 or 1.
+	if n, ok := data.(int); ok && (n == 0 || n == 1) {
+		data = n == 1
+	}
+	r.validateType(field, data, "bool")
+	lines = append(lines, fmt.Sprintf("Open in list view: %v", data))
+	return lines
+}
+
+func decodeExtension(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "str")
+	lines = append(lines, "Extension: "+r.describeExtension(data))
+	return lines
+}
+
+func decodeWindowInfo(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 16)
+	b := data.([]byte)
+	top := int16(binary.BigEndian.Uint16(b[0:2]))
+	left := int16(binary.BigEndian.Uint16(b[2:4]))
+	bottom := int16(binary.BigEndian.Uint16(b[4:6]))
+	right := int16(binary.BigEndian.Uint16(b[6:8]))
+	lines = append(lines, "Finder window information:")
+	lines = append(lines, fmt.Sprintf("\tWindow rectangle: top %d, left %d, bottom %d, right %d",
+		top, left, bottom, right))
+	view := viewStyleName(string(b[8:12]))
+	lines = append(lines, fmt.Sprintf("View style (might be overtaken): %s", view))
+	flags := b[12:16]
+	lines = append(lines, fmt.Sprintf("Window flags: %s", showOne(flags)))
+	for _, bit := range fwi0FlagBits {
+		lines = append(lines, fmt.Sprintf("\t%s: %v", bit.name, flags[bit.index]&bit.mask != 0))
+	}
+	if unknown := unknownFlagBits(flags, fwi0FlagBits); len(unknown) > 0 {
+		lines = append(lines, fmt.Sprintf("\tUnknown bits set: %s", strings.Join(unknown, ", ")))
+	}
+	return lines
+}
+
+func decodeSidebarWidth(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, "Finder window sidebar width: "+showInt(data))
+	return lines
+}
+
+func decodeWindowHeight(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, "Finder window vertical height (overrides Finder window information): "+showInt(data))
+	return lines
+}
+
+func decodeUnknownBytes(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 8)
+	lines = append(lines, fmt.Sprintf("%s (unknown): %s", field, showOne(data)))
+	return lines
+}
+
+func decodeIconViewOptions(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	b := data.([]byte)
+	lines = append(lines, "Icon view options:")
+	icvoType := string(b[0:4])
+	switch icvoType {
+	case "icvo":
+		if len(b) == 18 {
+			flags := b[4:12]
+			size := int(int16(binary.BigEndian.Uint16(b[12:14])))
+			arrangeRaw := string(b[14:18])
+			arrange := ArrangeModes[arrangeRaw]
+			if arrange == "" {
+				arrange = "(unknown) " + arrangeRaw
+			}
+			lines = append(lines, fmt.Sprintf("\tFlags (?): %s", showOne(flags)))
+			lines = append(lines, fmt.Sprintf("\tSize: %dpx", size))
+			lines = append(lines, fmt.Sprintf("\tKeep arranged by: %s", arrange))
+		} else {
+			warn("bad-length", -1, "icvo data not length 18")
+			lines = append(lines, "\t(unrecognized icvo)")
+		}
+	case "icv4":
+		if len(b) == 26 {
+			size := int(int16(binary.BigEndian.Uint16(b[4:6])))
+			arrangeRaw := string(b[6:10])
+			arrange := ArrangeModes[arrangeRaw]
+			if arrange == "" {
+				arrange = "(unknown) " + arrangeRaw
+			}
+			labelRaw := string(b[10:14])
+			label := LabelPositions[labelRaw]
+			if label == "" {
+				label = "(unknown) " + labelRaw
+			}
+			flags := b[14:26]
+			lines = append(lines, fmt.Sprintf("\tSize: %dpx", size))
+			lines = append(lines, fmt.Sprintf("\tKeep arranged by: %s", arrange))
+			lines = append(lines, fmt.Sprintf("\tLabel position: %s", label))
+			lines = append(lines, "\tFlags (partially known):")
+			lines = append(lines, fmt.Sprintf("\t\tRaw flags: %s", showOne(flags)))
+			for _, bit := range icv4FlagBits {
+				lines = append(lines, fmt.Sprintf("\t\t%s: %v", bit.name, flags[bit.index]&bit.mask != 0))
+			}
+			if unknown := unknownFlagBits(flags, icv4FlagBits); len(unknown) > 0 {
+				lines = append(lines, fmt.Sprintf("\t\tUnknown bits set: %s", strings.Join(unknown, ", ")))
+			}
+		} else {
+			warn("bad-length", -1, "icv4 data not length 26")
+			lines = append(lines, "\t(unrecognized icv4)")
+		}
+	default:
+		warn("unknown-icvo-type", -1, "Unrecognized icon view options type "+icvoType)
+		lines = append(lines, "\t(unrecognized): "+showOne(data))
+	}
+	return lines
+}
+
+func decodeIconViewPlist(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	val := r.Decode(field)
+	lines = append(lines, r.plistLabel("Icon view property list", field))
+	for _, l := range show(val, 1) {
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func decodeIconTextSize(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, "Icon view text size: "+textSize(data))
+	return lines
+}
+
+func decodeInfo(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	b, _ := data.([]byte)
+	lines = append(lines, infoLines(b)...)
+	return lines
+}
+
+func decodeLogicalSize(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, fmt.Sprintf("Logical size: %sB", showInt(data)))
+	return lines
+}
+
+func decodeListScrollPosition(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 8)
+	lines = append(lines, fmt.Sprintf("%s (unknown, List view scroll position?): %s", field, showOne(data)))
+	return lines
+}
+
+func decodeListViewColumnsAlt(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	val := r.Decode(field)
+	lines = append(lines, r.plistLabel("List view properties, alternative", field))
+	lines = append(lines, listViewLines(val)...)
+	return lines
+}
+
+func decodeListViewColumnsOther(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	val := r.Decode(field)
+	lines = append(lines, r.plistLabel("List view properties, other alternative", field))
+	lines = append(lines, listViewLines(val)...)
+	return lines
+}
+
+func decodeListViewOptions(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes", 76)
+	lines = append(lines, fmt.Sprintf("List view options (format unknown): %s", showOne(data)))
+	return lines
+}
+
+func decodeListViewColumns(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "bytes")
+	val := r.Decode(field)
+	lines = append(lines, r.plistLabel("List view properties", field))
+	lines = append(lines, listViewLines(val)...)
+	return lines
+}
+
+func decodeListTextSize(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, "List view text size: "+textSize(data))
+	return lines
+}
+
+func decodeModificationDate(r *Record, field string, data interface{}) (lines []string) {
+	// moDD and modD may be int or bytes
+	label := "Modification date"
+	if field == "modD" {
+		label = "Modification date, alternative"
+	}
+	if b, ok := data.([]byte); ok {
+		switch order, ambiguous := blobDateOrder(b); {
+		case ambiguous:
+			warn("ambiguous-date", -1, fmt.Sprintf("%v %s %x is a plausible date in either byte order; reading it little-endian", r, field, b))
+		case order == binary.BigEndian:
+			label += " (big-endian)"
+		}
+	}
+	if seconds, ok := macDateSeconds(data); ok {
+		lines = append(lines, fmt.Sprintf("%s: %s", label, showDate(seconds)))
+	} else if b, ok := data.([]byte); ok && len(b) <= 8 {
+		// Just parse what we can
+		padded := make([]byte, 8)
+		copy(padded, b)
+		lines = append(lines, fmt.Sprintf("%s (timestamp, format unknown): %d", label, binary.LittleEndian.Uint64(padded)))
+	} else {
+		lines = append(lines, fmt.Sprintf("%s (timestamp, unknown): %s", label, showOne(data)))
+	}
+	return lines
+}
+
+func decodeSettingsDate(r *Record, field string, data interface{}) (lines []string) {
+	// Some stores give the "." record when its view settings were last
+	// written.
+	r.validateType(field, data, "int")
+	label := "Settings date"
+	if !r.IsDirectorySettings() {
+		label = field + " (unknown, date?)"
+	}
+	if seconds, ok := macDateSeconds(data); ok {
+		lines = append(lines, fmt.Sprintf("%s: %s", label, showDate(seconds)))
+	} else {
+		lines = append(lines, fmt.Sprintf("%s (timestamp, unknown): %s", label, showOne(data)))
+	}
+	return lines
+}
+
+func decodePhysicalSize(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, fmt.Sprintf("Physical size: %sB", showInt(data)))
+	return lines
+}
+
+func decodePutBackLocation(r *Record, field string, data interface{}) (lines []string) {
+	// Trash only: the directory a trashed item came from, relative to
+	// the root of its volume.
+	if loc, ok := data.(string); ok {
+		if where, ok := r.PutBackPath(render.volume); ok && render.volume != "" {
+			lines = append(lines, fmt.Sprintf("Put back location: %s (resolves to %s)", loc, where))
+		} else {
+			lines = append(lines, fmt.Sprintf("Put back location: %s", loc))
+		}
+	} else {
+		lines = append(lines, fmt.Sprintf("Put back location (unresolved): %s", showOne(data)))
+	}
+	return lines
+}
+
+func decodePutBackName(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "str")
+	lines = append(lines, fmt.Sprintf("Put back name: %v", data))
+	return lines
+}
+
+func decodePicture(r *Record, field string, data interface{}) (lines []string) {
+	// pict with BKGD
+	lines = append(lines, fmt.Sprintf("Picture: %s", showOne(data)))
+	return lines
+}
+
+func decodeVSrn(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "int")
+	lines = append(lines, fmt.Sprintf("%s (unknown): %s", field, showInt(data)))
+	return lines
+}
+
+func decodeViewStyle(r *Record, field string, data interface{}) (lines []string) {
+	r.validateType(field, data, "str")
+	view := viewStyleName(data.(string))
+	lines = append(lines, fmt.Sprintf("View style: %s", view))
+	return lines
+}
+
+// ViewStyle is a Finder view style as stored in fwi0 and vstl: a four-char
+// code such as "icnv".
+type ViewStyle string
+
+const (
+	IconView      ViewStyle = "icnv"
+	ColumnView    ViewStyle = "clmv"
+	GalleryView   ViewStyle = "glyv"
+	ListView      ViewStyle = "Nlsv"
+	CoverflowView ViewStyle = "Flwv"
+)
+
+// ViewStyles maps each known view style to its display name.
+var ViewStyles = map[ViewStyle]string{
+	IconView:      "Icon view",
+	ColumnView:    "Column view",
+	GalleryView:   "Gallery view",
+	ListView:      "List view",
+	CoverflowView: "Coverflow view",
+}
+
+// Known reports whether v is one of the view styles in ViewStyles.
+func (v ViewStyle) Known() bool {
+	_, ok := ViewStyles[v]
+	return ok
+}
+
+// String returns the display name, e.g. "List view", or the raw code
+// marked as unrecognized.
+func (v ViewStyle) String() string {
+	if name, ok := ViewStyles[v]; ok {
+		return name
+	}
+	return "(unrecognized) " + string(v)
+}
+
+// viewStyleName returns the display name of a view style code, warning
+// about codes it does not know.
+func viewStyleName(code string) string {
+	v := ViewStyle(code)
+	if !v.Known() {
+		warn("unknown-view-style", -1, "Unrecognized view style "+code)
+	}
+	return v.String()
+}
+
+// ArrangeModes maps the four-char "keep arranged by" codes of icvo and icv4
+// to display names. Besides none and grid these are the sort keys Finder
+// offers in View > Arrange By; newer releases record the same choice in
+// icvp under arrangeBy instead.
+var ArrangeModes = map[string]string{
+	"none": "None",
+	"grid": "Snap to Grid",
+	"name": "Name",
+	"modd": "Date Modified",
+	"size": "Size",
+	"kind": "Kind",
+	"labl": "Label",
+}
+
+// LabelPositions maps the four-char icon label position codes of icv4 to
+// display names.
+var LabelPositions = map[string]string{
+	"botm": "Bottom",
+	"rght": "Right",
+}
+
+// BackgroundTypes maps the four-char background types at the start of BKGD
+// to display names.
+var BackgroundTypes = map[string]string{
+	"DefB": "Default",
+	"ClrB": "Color",
+	"PctB": "Picture",
+}
+
+// describeExtension renders a stored extn value, noting when it diverges
+// from the extension of the record's own filename. A mismatch can reveal a
+// file whose apparent type differs from its real one.
+func (r *Record) describeExtension(data interface{}) string {
+	stored, ok := data.(string)
+	if !ok {
+		return fmt.Sprintf("%v", data)
+	}
+	actual := strings.TrimPrefix(path.Ext(r.name), ".")
+	switch {
+	case strings.EqualFold(stored, actual):
+		return stored
+	case stored == "":
+		return fmt.Sprintf("(empty; filename extension %q)", actual)
+	case actual == "":
+		return fmt.Sprintf("%s (filename has no extension)", stored)
+	default:
+		return fmt.Sprintf("%s (differs from filename extension %q)", stored, actual)
+	}
+}
+
+// ilocPosition decodes the icon x and y coordinates from an Iloc blob. They
+// are signed, as for dilc: icons dragged past the window's top or left edge
+// have negative ones.
+func ilocPosition(b []byte) (x, y int) {
+	return int(int32(binary.BigEndian.Uint32(b[0:4]))), int(int32(binary.BigEndian.Uint32(b[4:8])))
+}
+
+// ilocAutoArranged is the value of an Iloc's third word when Finder places
+// the icon itself.
+const ilocAutoArranged = 0xffffffff
+
+// ilocIndex decodes the sort index Finder's snap-to-grid ordering keeps in
+// the word after an Iloc's coordinates. ok is false when the word holds the
+// auto-arranged sentinel, or the blob is too short to have it.
+func ilocIndex(b []byte) (index int, ok bool) {
+	if len(b) < 12 {
+		return 0, false
+	}
+	word := binary.BigEndian.Uint32(b[8:12])
+	if word == ilocAutoArranged {
+		return 0, false
+	}
+	return int(word), true
+}
+
+// Finder's view options offer text sizes from 10 to 16 points.
+const (
+	minTextSize = 10
+	maxTextSize = 16
+)
+
+// textSize renders an lsvt or icvt text size in points, warning when it is
+// outside the sizes Finder offers, which suggests a corrupt value.
+func textSize(data interface{}) string {
+	if n, ok := data.(int); ok && (n < minTextSize || n > maxTextSize) {
+		warn("implausible-text-size", -1, fmt.Sprintf("Text size %dpt outside Finder's %d-%dpt", n, minTextSize, maxTextSize))
+	}
+	return showInt(data) + "pt"
+}
+
+// infoLengths are the info sizes seen in the wild.
+var infoLengths = map[int]bool{40: true, 48: true}
+
+// infoLines renders an info blob. Its layout is not documented: stores have
+// been seen holding 40 or 48 bytes, the first eight of which often read as
+// a plausible big-endian dutc timestamp. Everything else is shown as raw
+// 32-bit words so patterns across files stand out.
+func infoLines(b []byte) []string {
+	label := fmt.Sprintf("Info (partially decoded, %d bytes", len(b))
+	if !infoLengths[len(b)] {
+		label += ", unusual length"
+	}
+	lines := []string{label + "):"}
+	rest := b
+	if len(b) >= 8 {
+		seconds := float64(int64(binary.BigEndian.Uint64(b[:8]))) / 65536.0
+		if plausibleDate(seconds) {
+			lines = append(lines, "\tPossible date: "+showDate(seconds))
+			rest = b[8:]
+		}
+	}
+	for i := 0; i+4 <= len(rest); i += 4 {
+		lines = append(lines, fmt.Sprintf("\tWord %d: 0x%08x", (len(b)-len(rest)+i)/4, binary.BigEndian.Uint32(rest[i:i+4])))
+	}
+	if tail := len(rest) % 4; tail != 0 {
+		lines = append(lines, "\tTrailing bytes: "+showOne(rest[len(rest)-tail:]))
+	}
+	return lines
+}
+
+// flagBit names one bit of a flags byte string.
+type flagBit struct {
+	index int
+	mask  byte
+	name  string
+}
+
+// icv4FlagBits are the bits of the 12 icv4 flag bytes whose meaning is
+// known: only the two the parser has always decoded. The label position has
+// its own four-char code before the flags. No other bit has been confirmed
+// against stores Finder wrote, so the rest are reported by position when
+// set rather than guessed at.
+var icv4FlagBits = []flagBit{
+	{1, 0x01, "Show item info"},
+	{11, 0x01, "Show icon preview"},
+}
+
+// fwi0FlagBits are the known bits of the four bytes after the fwi0 view
+// style. Windows with a toolbar store 00 01 00 00; hiding the toolbar
+// clears that bit. Sidebar visibility is not kept here but in bwsp's
+// ShowSidebar.
+var fwi0FlagBits = []flagBit{
+	{1, 0x01, "Toolbar visible"},
+}
+
+// unknownFlagBits lists the set bits of flags not covered by known, as
+// "byte N bit M" strings.
+func unknownFlagBits(flags []byte, known []flagBit) []string {
+	var unknown []string
+	for i, b := range flags {
+		for bit := 0; bit < 8; bit++ {
+			mask := byte(1) << bit
+			if b&mask == 0 {
+				continue
+			}
+			isKnown := false
+			for _, k := range known {
+				if k.index == i && k.mask&mask != 0 {
+					isKnown = true
+					break
+				}
+			}
+			if !isKnown {
+				unknown = append(unknown, fmt.Sprintf("byte %d bit %d", i, bit))
+			}
+		}
+	}
+	return unknown
+}
+
+// listViewColumn is one column of a list view property list.
+type listViewColumn struct {
+	id        string
+	index     int64
+	width     int64
+	visible   bool
+	ascending bool
+}
+
+// listViewLines renders a decoded lsvp, lsvC or lsvP property list. Its
+// columns are laid out as a table in display order, marking the column the
+// view is sorted by; the other keys are dumped as usual.
+func listViewLines(val interface{}) []string {
+	props, ok := val.(map[string]interface{})
+	if !ok || render.rawPlists {
+		return show(val, 1)
+	}
+	var columns []listViewColumn
+	switch c := props["columns"].(type) {
+	case map[string]interface{}:
+		// Newer stores key the columns by identifier.
+		for id, v := range c {
+			columns = append(columns, newListViewColumn(id, v))
+		}
+	case []interface{}:
+		// Older ones list them in order, each naming its identifier.
+		for i, v := range c {
+			col := newListViewColumn("", v)
+			if m, ok := v.(map[string]interface{}); ok {
+				col.id, _ = m["identifier"].(string)
+			}
+			if _, ok := plistInt(v, "index"); !ok {
+				col.index = int64(i)
+			}
+			columns = append(columns, col)
+		}
+	default:
+		return show(val, 1)
+	}
+	sort.SliceStable(columns, func(i, j int) bool {
+		if columns[i].index != columns[j].index {
+			return columns[i].index < columns[j].index
+		}
+		return columns[i].id < columns[j].id
+	})
+
+	rest := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		if k != "columns" {
+			rest[k] = v
+		}
+	}
+	lines := show(rest, 1)
+	sortColumn, _ := props["sortColumn"].(string)
+	idWidth := len("Column")
+	for _, c := range columns {
+		if len(c.id) > idWidth {
+			idWidth = len(c.id)
+		}
+	}
+	lines = append(lines, "\tColumns:")
+	lines = append(lines, fmt.Sprintf("\t\t%-*s  %5s  %-7s  %s", idWidth, "Column", "Width", "Visible", "Sort"))
+	for _, c := range columns {
+		visible, order := "no", ""
+		if c.visible {
+			visible = "yes"
+		}
+		if c.id == sortColumn {
+			order = "descending"
+			if c.ascending {
+				order = "ascending"
+			}
+		}
+		lines = append(lines, strings.TrimRight(fmt.Sprintf("\t\t%-*s  %5d  %-7s  %s", idWidth, c.id, c.width, visible, order), " "))
+	}
+	return lines
+}
+
+// newListViewColumn reads a column's settings from its plist dictionary.
+func newListViewColumn(id string, v interface{}) listViewColumn {
+	col := listViewColumn{id: id}
+	m, _ := v.(map[string]interface{})
+	col.index, _ = plistInt(m, "index")
+	col.width, _ = plistInt(m, "width")
+	col.visible, _ = m["visible"].(bool)
+	col.ascending, _ = m["ascending"].(bool)
+	return col
+}
+
+// plistInt returns the integer under key of a plist dictionary, which
+// decodes as uint64 or int64 depending on its sign and the plist format.
+func plistInt(v interface{}, key string) (int64, bool) {
+	m, _ := v.(map[string]interface{})
+	switch n := m[key].(type) {
+	case uint64:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// plistFormatNames names the formats plist.Decoder detects.
+var plistFormatNames = map[int]string{
+	plist.BinaryFormat:   "binary",
+	plist.XMLFormat:      "XML",
+	plist.OpenStepFormat: "OpenStep",
+	plist.GNUStepFormat:  "GNUstep",
+}
+
+// parsePlist attempts to parse a plist from a byte slice, also returning
+// the format it was stored in.
+func parsePlist(data []byte) (interface{}, string) {
+	decoder := plist.NewDecoder(bytes.NewReader(data))
+	var val interface{}
+	if err := decoder.Decode(&val); err != nil {
+		// return raw if fail
+		return data, ""
+	}
+	return val, plistFormatNames[decoder.Format]
+}
+
+// ErrTooSmall is returned by Parse for content too short to hold a header.
+var ErrTooSmall = errors.New("file too small to be a DS_Store")
+
+// UnsupportedVersionError is returned by Parse for a header magic of a Bud
+// version other than Bud1, whose layout this parser does not know.
+type UnsupportedVersionError struct {
+	Magic  string
+	Offset int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported store version %q at %#x", e.Magic, e.Offset)
+}
+
+// MasterBlockError is returned by Parse, when ValidateMaster is set, for a
+// master block whose fifth int is not a plausible page size, see
+// plausiblePageSize.
+type MasterBlockError struct {
+	Value  uint32
+	Offset int
+}
+
+func (e *MasterBlockError) Error() string {
+	return fmt.Sprintf("master block page size %#x at %#x is implausible; the master offset is probably wrong", e.Value, e.Offset)
+}
+
+// Page sizes that plausiblePageSize accepts.
+const (
+	minPageSize = 0x200
+	maxPageSize = 0x10000
+)
+
+// plausiblePageSize reports whether v could be the page size in the master
+// block's fifth int. Finder always writes pageSize, 0x1000. Another power
+// of two is what a different writer could choose, and parses just the
+// same, so it is only noted. Zero, or anything else, means the master key
+// led to something other than the master block, and its root, height and
+// counts are likely garbage too.
+func plausiblePageSize(v uint32) bool {
+	return v >= minPageSize && v <= maxPageSize && v&(v-1) == 0
+}
+
+// MissingKeyError is returned by Parse when the allocator's table of
+// contents has no entry for the master node key, which usually means the
+// input is not a .DS_Store at all.
+type MissingKeyError struct {
+	Key string
+}
+
+func (e *MissingKeyError) Error() string {
+	return fmt.Sprintf("key %q not found in table of contents", e.Key)
+}
+
+// UnknownTypeError reports a record whose data type is not one this
+// parser knows how to size.
+type UnknownTypeError struct {
+	Type   string
+	Offset int
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unrecognized data type %q at %#x", e.Type, e.Offset)
+}
+
+// DSStore struct
+type DSStore struct {
+	content          []byte
+	cursor           int
+	records          []*Record
+	// byName indexes records by their exact name.
+	byName           map[string]*Record
+	offsets          []uint32
+	allocatorOffset  uint32
+	allocatorLength  uint32
+	directory        map[string]uint32
+	masterID         uint32
+	freelist         map[uint32][]uint32
+	rootID           uint32
+	treeHeight       uint32
+	numRecords       uint32
+	numNodes         uint32
+	// SkipUnknownTypes makes the parser abandon just the rest of a tree node
+	// holding a data type it cannot size, instead of failing the parse.
+	SkipUnknownTypes bool
+	// NormalizeNames converts record names to Unicode NFC as they are read.
+	// macOS stores names decomposed, so without it "é" is an e followed by
+	// a combining accent and will not match names from other systems.
+	NormalizeNames bool
+	// MasterKey is the allocator directory key of the master block. Empty
+	// means "DSDB", falling back to any other key that leads to a usable
+	// master when the store has no DSDB; a key set explicitly must exist.
+	MasterKey string
+	// AllocatorOffset chooses between the two copies of the allocator
+	// offset in the header when they disagree.
+	AllocatorOffset AllocatorOffsetChoice
+	// PreserveInvalidNames keeps unpaired UTF-16 surrogates in record names
+	// as WTF-8 instead of replacing them with U+FFFD, so the exact stored
+	// name can be recovered with its UTF-16 encoding. Such names are not
+	// valid UTF-8; encoding/json, for one, still replaces them.
+	PreserveInvalidNames bool
+	// ValidateMaster makes Parse fail with a MasterBlockError when the
+	// master block's page size is implausible, instead of warning and
+	// reading on.
+	ValidateMaster bool
+	// HashIgnoredFields are the field codes StableHash leaves out. Nil
+	// means VolatileFields; an empty map hashes every field.
+	HashIgnoredFields map[string]bool
+	// EmbeddedDepth is how many levels of stores nested in blob fields
+	// Parse reads along with this one, for Record.Embedded and the text
+	// output. Deeper stores, or all of them when it is 0, are left as
+	// bytes.
+	EmbeddedDepth int
+	// WarningSink receives the warnings raised while parsing the store.
+	// Nil means the sink set with SetWarningSink. Warnings raised while
+	// decoding its records' fields always go to the latter.
+	WarningSink WarningSink
+	// scope is the record and field being parsed, which d.warn attaches to
+	// each warning.
+	scope warningScope
+	// alignmentAlreadyStripped is set for embedded stores, whose content
+	// starts at the Bud1 magic rather than at the 4-byte alignment int.
+	alignmentAlreadyStripped bool
+	// baseOffset is the position of the Bud1 magic in content, which block
+	// addresses are relative to. parseHeader sets it.
+	baseOffset uint32
+	// allocatorOffsetRepeat is the header's second copy of allocatorOffset.
+	allocatorOffsetRepeat uint32
+	// version is the header magic, see Version.
+	version string
+	// onEntry, if set, receives each entry as the tree is walked instead of
+	// it being added to records. An error stops the walk.
+	onEntry func(name, field string, value interface{}, raw rawValue) error
+	// patches are same-length value replacements to apply to content when
+	// encoding, and rebuild is set once a change needs the tree rebuilt.
+	patches []rawValue
+	rebuild bool
+	// streamErr is the error that ended the last Stream.
+	streamErr error
+	// duplicates are the fields found more than once in a record, see
+	// DuplicateFields.
+	duplicates []DuplicateField
+	// stats and depth, the current recursion depth of the tree walk, track
+	// the last Parse.
+	stats ParseStats
+	depth int
+}
+
+func NewDSStore(content []byte) *DSStore {
+	return &DSStore{
+		content:  content,
+		records:  make([]*Record, 0),
+		directory: make(map[string]uint32),
+		freelist:  make(map[uint32][]uint32),
+	}
+}
+
+// IsDSStore cheaply reports whether content starts like a store: the
+// alignment int 0x00000001 followed by the Bud1 magic, or just the magic as
+// in embedded stores. It does not parse anything further.
+func IsDSStore(content []byte) bool {
+	if len(content) >= 8 && binary.BigEndian.Uint32(content) == 0x00000001 && string(content[4:8]) == "Bud1" {
+		return true
+	}
+	return len(content) >= 4 && string(content[0:4]) == "Bud1"
+}
+
+// NewDSStoreFromSlice returns a store over buf[off:off+length] without
+// copying it, for stores carved out of a larger image. The range may start
+// at the alignment int or directly at the Bud1 magic.
+func NewDSStoreFromSlice(buf []byte, off, length int) (*DSStore, error) {
+	if off < 0 || length < 0 || off > len(buf) || length > len(buf)-off {
+		return nil, fmt.Errorf("range %d+%d outside buffer of %d bytes", off, length, len(buf))
+	}
+	content := buf[off : off+length : off+length]
+	if !IsDSStore(content) {
+		return nil, fmt.Errorf("no DS_Store header at offset %d", off)
+	}
+	if string(content[0:4]) == "Bud1" {
+		return newEmbeddedDSStore(content), nil
+	}
+	return NewDSStore(content), nil
+}
+
+// newEmbeddedDSStore returns a store for content that begins at the Bud1
+// magic, as stores nested inside blob fields do.
+func newEmbeddedDSStore(content []byte) *DSStore {
+	d := NewDSStore(content)
+	d.alignmentAlreadyStripped = true
+	return d
+}
+
+// parseEmbedded parses the store held by field of r, when it holds one and
+// d.EmbeddedDepth allows, with d's options and one level less of depth. A
+// store that does not parse is left as bytes, with a warning.
+func (d *DSStore) parseEmbedded(r *Record, field string) {
+	data, ok := r.fields[field].([]byte)
+	if d.EmbeddedDepth <= 0 || !ok || !bytes.HasPrefix(data, []byte("Bud1")) {
+		return
+	}
+	nested := newEmbeddedDSStore(data)
+	nested.EmbeddedDepth = d.EmbeddedDepth - 1
+	nested.SkipUnknownTypes = d.SkipUnknownTypes
+	nested.NormalizeNames = d.NormalizeNames
+	nested.PreserveInvalidNames = d.PreserveInvalidNames
+	nested.WarningSink = d.WarningSink
+	// The nested store's problems belong to the field holding it, or to
+	// the one holding d when d is nested itself.
+	nested.scope = d.scope
+	if nested.scope.record == "" {
+		nested.scope = warningScope{record: r.name, field: field}
+	}
+	if err := nested.Parse(); err != nil {
+		d.warn("bad-embedded", r.raw[field].offset, fmt.Sprintf("Could not parse the store embedded in %s of %s: %v", field, r.name, err))
+		return
+	}
+	for _, nr := range nested.records {
+		nr.nested = true
+	}
+	if r.embedded == nil {
+		r.embedded = make(map[string]*DSStore)
+	}
+	r.embedded[field] = nested
+}
+
+// Embedded returns the store nested in field, as parsed along with the
+// record's own store up to its EmbeddedDepth, or nil when there is none.
+func (r *Record) Embedded(field string) *DSStore {
+	return r.embedded[field]
+}
+
+func (d *DSStore) readRecords() []*Record {
+	return d.records
+}
+
+// AsMap returns every record's fields by record name and field code, each
+// value as Decode gives it, with embedded plists parsed. It is a plain
+// snapshot to compare against in tests: byte slices and parsed plists are
+// copied, so changing it leaves the store as it was.
+func (d *DSStore) AsMap() map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{}, len(d.records))
+	for _, r := range d.records {
+		fields := make(map[string]interface{}, len(r.fields))
+		for field := range r.fields {
+			fields[field] = copyValue(r.Decode(field))
+		}
+		out[r.name] = fields
+	}
+	return out
+}
+
+// copyValue returns a copy of v sharing no byte slices, maps or slices with
+// it. Other values are immutable and returned as they are.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return bytes.Clone(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = copyValue(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = copyValue(value)
+		}
+		return s
+	}
+	return v
+}
+
+// Comments returns the Spotlight comment (cmmt) of every record that has a
+// non-empty one, keyed by filename.
+func (d *DSStore) Comments() map[string]string {
+	comments := make(map[string]string)
+	for _, r := range d.records {
+		if c, ok := r.fields["cmmt"].(string); ok && c != "" {
+			comments[r.name] = c
+		}
+	}
+	return comments
+}
+
+// IconLocations returns the icon position (Iloc) of every record that has
+// one, keyed by filename, in Finder window coordinates.
+func (d *DSStore) IconLocations() map[string]image.Point {
+	locations := make(map[string]image.Point)
+	for _, r := range d.records {
+		if b, ok := r.fields["Iloc"].([]byte); ok && len(b) >= 8 {
+			x, y := ilocPosition(b)
+			locations[r.name] = image.Pt(x, y)
+		}
+	}
+	return locations
+}
+
+// housekeepingFields are what Finder records on its own as folders are
+// browsed: view and window settings on the "." record, and icon positions
+// and modification dates on the items.
+var housekeepingFields = map[string]map[string]bool{
+	".": {
+		"bwsp": true, "icvp": true, "icvo": true, "icgo": true, "icsp": true, "icvt": true,
+		"lsvp": true, "lsvP": true, "lsvC": true, "lsvo": true, "lssp": true, "lsvt": true,
+		"fwi0": true, "fwsw": true, "fwvh": true, "vstl": true, "vSrn": true,
+		"BKGD": true, "moDD": true, "modD": true,
+	},
+	"": {"Iloc": true, "moDD": true, "modD": true},
+}
+
+// IsEssentiallyDefault reports whether the store holds nothing beyond what
+// Finder writes by itself while a folder is browsed, for setting aside the
+// many uninteresting stores in a corpus. That is, exactly when:
+//   - the "." record has only view, window, background and date fields;
+//   - its background, if any, is the default one (DefB);
+//   - every other record has only Iloc, moDD and modD.
+//
+// So a comment, a coloured or picture background, Trash put-back data, a
+// stored extension, a size or any unrecognized field all count as
+// customization. An empty store is essentially default.
+func (d *DSStore) IsEssentiallyDefault() bool {
+	for _, r := range d.records {
+		allowed := housekeepingFields[""]
+		if r.IsDirectorySettings() {
+			allowed = housekeepingFields["."]
+		}
+		for field, value := range r.fields {
+			if !allowed[field] {
+				return false
+			}
+			if b, ok := value.([]byte); field == "BKGD" && !(ok && bytes.HasPrefix(b, []byte("DefB"))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GroupByField returns, for every field code in the store, the names of the
+// records that carry it, in record order. It is the transpose of the
+// per-record view: GroupByField()["cmmt"] lists the files with comments.
+func (d *DSStore) GroupByField() map[string][]string {
+	groups := make(map[string][]string)
+	for _, r := range d.records {
+		for field := range r.fields {
+			groups[field] = append(groups[field], r.name)
+		}
+	}
+	return groups
+}
+
+// ProbableMacOSEra makes a coarse, best-effort guess at which macOS release
+// wrote the store, from the layout of its icon view options, the property
+// list fields that replaced them and its view styles. Fields every release
+// writes, such as fwi0 or Iloc, say nothing either way. It is a heuristic:
+// Finder rewrites only the records it touches, so a store can mix eras,
+// and the guess is the newest era with any evidence. It returns "" when
+// nothing in the store hints either way.
+func (d *DSStore) ProbableMacOSEra() string {
+	newest := -1
+	for _, r := range d.records {
+		for field, data := range r.fields {
+			era, ok := fieldEras[field]
+			switch field {
+			case "icvo":
+				if b, _ := data.([]byte); len(b) >= 4 {
+					era, ok = icvoEras[string(b[:4])]
+				}
+			case "vstl":
+				if v, _ := data.(string); ViewStyle(v) == GalleryView {
+					era, ok = 4, true
+				}
+			case "fwi0":
+				if b, _ := data.([]byte); len(b) >= 12 && ViewStyle(b[8:12]) == GalleryView {
+					era, ok = 4, true
+				}
+			}
+			if ok && era > newest {
+				newest = era
+			}
+		}
+	}
+	if newest < 0 {
+		return ""
+	}
+	return macOSEras[newest]
+}
+
+// macOSEras are the eras ProbableMacOSEra can report, oldest first.
+var macOSEras = []string{
+	"Mac OS X 10.3 or earlier",
+	"Mac OS X 10.4 or later",
+	"Mac OS X 10.6 or later",
+	"OS X 10.7 or later",
+	"macOS 10.14 or later",
+}
+
+// icvoEras maps the four-char type that starts an icvo blob to the index in
+// macOSEras of the era writing that layout: the 18-byte icvo one, or the
+// 26-byte icv4 one that followed it.
+var icvoEras = map[string]int{
+	"icvo": 0,
+	"icv4": 1,
+}
+
+// fieldEras maps the property list fields to the index in macOSEras of the
+// oldest era known to write them. Mac OS X 10.6 moved the icon view
+// options and browser window settings into icvp and bwsp, and OS X 10.7
+// the list view settings into lsvp and friends. The icvo layouts and the
+// gallery view style, which marks the newest era, are checked separately
+// since they are values rather than fields.
+var fieldEras = map[string]int{
+	"bwsp": 2,
+	"icvp": 2,
+	"lsvp": 3,
+	"lsvP": 3,
+	"lsvC": 3,
+}
+
+// read helpers
+func (d *DSStore) nextByte() byte {
+	b := d.content[d.cursor]
+	d.cursor++
+	d.stats.BytesRead++
+	return b
+}
+
+func (d *DSStore) nextBytes(n int) []byte {
+	b := d.content[d.cursor : d.cursor+n]
+	d.cursor += n
+	d.stats.BytesRead += n
+	return b
+}
+
+func (d *DSStore) nextUint32() uint32 {
+	b := d.nextBytes(4)
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *DSStore) nextUint64() uint64 {
+	b := d.nextBytes(8)
+	return binary.BigEndian.Uint64(b)
+}
+
+// parseHeader reads the header up to the allocator offsets. It fails only
+// for a magic of another Bud version; any other bad magic is warned about
+// and parsed as Bud1, since it may just be damage.
+func (d *DSStore) parseHeader() error {
+	if !d.alignmentAlreadyStripped {
+		alignment := d.nextUint32()
+		if alignment != 0x00000001 {
+			d.warn("bad-alignment", 0, fmt.Sprintf("Alignment int %x not 0x00000001", alignment))
+		}
+	}
+	d.baseOffset = uint32(d.cursor)
+	magic := d.nextBytes(4)
+	d.version = string(magic)
+	switch {
+	case d.version == "Bud1":
+	case strings.HasPrefix(d.version, "Bud"):
+		return &UnsupportedVersionError{Magic: d.version, Offset: d.cursor - 4}
+	default:
+		d.warn("bad-magic", d.cursor-4, fmt.Sprintf("Magic bytes %x not 0x42756431 (Bud1)", magic))
+	}
+	d.allocatorOffset = d.baseOffset + d.nextUint32()
+	d.allocatorLength = d.nextUint32()
+	d.allocatorOffsetRepeat = d.baseOffset + d.nextUint32()
+	if d.allocatorOffsetRepeat != d.allocatorOffset {
+		d.warn("allocator-offset-mismatch", d.cursor-4, fmt.Sprintf("Allocator offsets %x and %x unequal", d.allocatorOffset, d.allocatorOffsetRepeat))
+	}
+	return nil
+}
+
+// Version returns the format magic read from the header, "Bud1" for every
+// store seen so far, or "" before Parse.
+func (d *DSStore) Version() string {
+	return d.version
+}
+
+// TreeHeight returns the height of the record tree as the master block
+// records it: 0 when every record fits in a single leaf.
+func (d *DSStore) TreeHeight() int {
+	return int(d.treeHeight)
+}
+
+// NodeCount returns the number of tree nodes the master block records.
+func (d *DSStore) NodeCount() int {
+	return int(d.numNodes)
+}
+
+// IsMultiNode reports whether the records span more than one tree node.
+// Unlike TreeHeight and NodeCount, which a damaged master block may get
+// wrong, it goes by the nodes the last Parse actually visited.
+func (d *DSStore) IsMultiNode() bool {
+	return d.stats.Nodes > 1
+}
+
+// AllocatorOffsetChoice selects which of the header's two allocator offsets
+// Parse uses. They are normally equal; in damaged or recovered files they
+// sometimes differ and either one may be the intact copy.
+type AllocatorOffsetChoice int
+
+const (
+	// AllocatorOffsetAuto uses the first offset, and the second if the
+	// allocator fails to parse at the first. It is the default.
+	AllocatorOffsetAuto AllocatorOffsetChoice = iota
+	// AllocatorOffsetFirst always uses the first offset.
+	AllocatorOffsetFirst
+	// AllocatorOffsetSecond always uses the repeated offset.
+	AllocatorOffsetSecond
+)
+
+// parseChosenAllocator parses the allocator at the offset AllocatorOffset
+// selects, retrying at the repeated offset when automatic.
+func (d *DSStore) parseChosenAllocator() error {
+	switch d.AllocatorOffset {
+	case AllocatorOffsetSecond:
+		d.allocatorOffset = d.allocatorOffsetRepeat
+	case AllocatorOffsetAuto:
+		if d.allocatorOffsetRepeat == d.allocatorOffset {
+			break
+		}
+		err := d.tryParseAllocator()
+		if err == nil {
+			return nil
+		}
+		d.warn("allocator-offset-fallback", int(d.allocatorOffsetRepeat), fmt.Sprintf("Allocator at %x unreadable (%v); trying repeated offset %x", d.allocatorOffset, err, d.allocatorOffsetRepeat))
+		d.allocatorOffset = d.allocatorOffsetRepeat
+		d.directory = make(map[string]uint32)
+		d.freelist = make(map[uint32][]uint32)
+	}
+	return d.parseAllocator()
+}
+
+// tryParseAllocator is parseAllocator with out-of-range reads, which
+// otherwise panic up to Parse, returned as an error.
+func (d *DSStore) tryParseAllocator() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return d.parseAllocator()
+}
+
+func (d *DSStore) parseAllocator() error {
+	d.cursor = int(d.allocatorOffset)
+	numOffsets := d.nextUint32()
+	second := d.nextUint32()
+	if second != 0 {
+		d.warn("allocator-second-int", d.cursor-4, fmt.Sprintf("Second int of allocator %x not 0x00000000", second))
+	}
+	if err := d.checkCount("offsets", numOffsets, int(d.allocatorOffset), 4); err != nil {
+		return err
+	}
+	// Slice the whole table once rather than going through nextUint32 per
+	// entry; on large volumes it can hold tens of thousands of offsets.
+	table := d.nextBytes(4 * int(numOffsets))
+	d.offsets = make([]uint32, numOffsets)
+	for i := range d.offsets {
+		d.offsets[i] = binary.BigEndian.Uint32(table[4*i:])
+	}
+
+	// The offsets table is padded to a multiple of 256 entries and the
+	// table of contents follows it. Most stores have at most 256 blocks,
+	// which puts the table of contents at the familiar allocatorOffset+0x408.
+	slots := (int(numOffsets) + 255) / 256 * 256
+	if slots == 0 {
+		slots = 256
+	}
+	tocOffset := int(d.allocatorOffset) + 8 + 4*slots
+	if !d.plausibleKeyCount(tocOffset) {
+		legacy := int(d.allocatorOffset) + 0x408
+		if legacy != tocOffset && d.plausibleKeyCount(legacy) {
+			d.warn("toc-relocated", tocOffset, fmt.Sprintf("No plausible table of contents after %d offsets at %x; using %x instead", numOffsets, tocOffset, legacy))
+			tocOffset = legacy
+		} else {
+			d.warn("toc-implausible", tocOffset, fmt.Sprintf("Bytes at %x do not look like a table of contents key count", tocOffset))
+			return fmt.Errorf("no plausible table of contents at %#x", tocOffset)
+		}
+	}
+
+	d.cursor = tocOffset
+	numKeys := d.nextUint32()
+	// Each key takes at least a length byte, one key byte and a block ID.
+	if err := d.checkCount("directory keys", numKeys, tocOffset, 6); err != nil {
+		return err
+	}
+	for i := 0; i < int(numKeys); i++ {
+		keyOffset := d.cursor
+		keyLength := int(d.nextByte())
+		keyBytes := d.nextBytes(keyLength)
+		key := string(keyBytes)
+		val := d.nextUint32()
+		d.directory[key] = val
+		if key != d.masterKey() {
+			d.warn("extra-directory-key", keyOffset, fmt.Sprintf("Directory contains non-%q key %q and value %x", d.masterKey(), key, val))
+		}
+	}
+	masterID, err := d.findMaster()
+	if err != nil {
+		return err
+	}
+	d.masterID = masterID
+
+	used := d.usedBlocks()
+	for i := 0; i < 32; i++ {
+		countOffset := d.cursor
+		valuesLength := d.nextUint32()
+		if err := d.checkCount("free blocks", valuesLength, countOffset, 4); err != nil {
+			return err
+		}
+		start := d.cursor
+		entries := d.nextBytes(4 * int(valuesLength))
+		list := make([]uint32, valuesLength)
+		for j := range list {
+			list[j] = binary.BigEndian.Uint32(entries[4*j:])
+			d.checkFreeBlock(start+4*j, list[j], uint32(1)<<i, used)
+		}
+		d.freelist[1<<i] = list
+	}
+	d.checkTrailingData(used)
+	return nil
+}
+
+// Block is one allocated block listed in the allocator's offsets table.
+//
+// Each table entry packs a block's address and size into one uint32: the
+// low five bits hold log2 of the size, which is always a power of two of
+// at least 32 bytes, and the rest, with those bits cleared, the address.
+// Blocks are aligned to their size, so the address never needs the low
+// bits. Addresses count from the Bud1 magic, just past the alignment int.
+type Block struct {
+	// Index is the block's ID, by which the tree and the table of contents
+	// refer to it.
+	Index int
+	// Address is where the block starts, relative to the Bud1 magic, and
+	// Offset the same position in the parsed content.
+	Address uint32
+	Offset  int
+	Size    int64
+}
+
+// Blocks returns every allocated block in ID order, skipping the unused
+// entries that pad the offsets table. It is only meaningful after Parse.
+func (d *DSStore) Blocks() []Block {
+	var blocks []Block
+	for id, w := range d.offsets {
+		if w == 0 {
+			continue
+		}
+		blocks = append(blocks, Block{
+			Index:   id,
+			Address: (w >> 5) << 5,
+			Offset:  d.blockOffset(w),
+			Size:    int64(1) << (w & 0x1f),
+		})
+	}
+	return blocks
+}
+
+// blockSpan is the address range of one block, relative to baseOffset.
+type blockSpan struct {
+	id         int
+	start, end int64
+}
+
+// usedBlocks returns the spans of the blocks in the offsets table, sorted
+// by start address. Zero entries are unused slots and are left out.
+func (d *DSStore) usedBlocks() []blockSpan {
+	var spans []blockSpan
+	for _, b := range d.Blocks() {
+		spans = append(spans, blockSpan{id: b.Index, start: int64(b.Address), end: int64(b.Address) + b.Size})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	return spans
+}
+
+// trailingDataSlack is how many bytes may follow the last block before
+// checkTrailingData warns. Carved or concatenated files leave far more.
+const trailingDataSlack = 0x200
+
+// checkTrailingData warns when content continues well past the end of the
+// last used block and the allocator, as in carved or concatenated files.
+// Free blocks don't count: Finder's freelist lists free buddies all the way
+// to the end of the 2GiB address space. The extra bytes are never read.
+func (d *DSStore) checkTrailingData(used []blockSpan) {
+	end := int64(d.allocatorEnd())
+	for _, u := range used {
+		if e := int64(d.baseOffset) + u.end; e > end {
+			end = e
+		}
+	}
+	if extra := int64(len(d.content)) - end; extra > trailingDataSlack {
+		d.warn("trailing-data", int(end), fmt.Sprintf("Ignoring %d bytes after the last block, which ends at %#x", extra, end))
+	}
+}
+
+// checkFreeBlock warns about a freelist entry, read at entryOffset, whose
+// block of the given size is not a valid buddy block or overlaps a block
+// the offsets table says is in use. Freelist entries are addresses relative
+// to baseOffset, not indices into the offsets table. The buddy allocator
+// manages a 2GiB address space, so free blocks past the end of the file
+// are normal; Finder lists all the space it has never used.
+func (d *DSStore) checkFreeBlock(entryOffset int, addr, size uint32, used []blockSpan) {
+	start, end := int64(addr), int64(addr)+int64(size)
+	if end > 1<<31 {
+		d.warn("free-block-out-of-range", entryOffset, fmt.Sprintf("Free block %#x of %d bytes ends past the allocator's address space", addr, size))
+		return
+	}
+	if addr%size != 0 {
+		d.warn("free-block-misaligned", entryOffset, fmt.Sprintf("Free block %#x of %d bytes is not aligned to its size", addr, size))
+		return
+	}
+	// Spans starting before end are the only candidates to overlap.
+	n := sort.Search(len(used), func(i int) bool { return used[i].start >= end })
+	for _, u := range used[:n] {
+		if u.end > start {
+			d.warn("free-block-in-use", entryOffset, fmt.Sprintf("Free block %#x of %d bytes overlaps block %d at %#x, which is in use", addr, size, u.id, u.start))
+			return
+		}
+	}
+}
+
+// blockOffset returns the content position of the block an offsets table
+// entry points to. The low five bits of an entry hold the block's size as a
+// power of two; the rest is its address relative to baseOffset.
+func (d *DSStore) blockOffset(offsetAndSize uint32) int {
+	return int(d.baseOffset) + int((offsetAndSize>>5)<<5)
+}
+
+// masterKey is the directory key naming the master block.
+func (d *DSStore) masterKey() string {
+	if d.MasterKey != "" {
+		return d.MasterKey
+	}
+	return "DSDB"
+}
+
+// findMaster returns the master block's ID from the directory. Without an
+// explicit MasterKey, a store lacking DSDB falls back to the first other key,
+// in sorted order, whose block looks like a master.
+func (d *DSStore) findMaster() (uint32, error) {
+	if id, ok := d.directory[d.masterKey()]; ok {
+		return id, nil
+	}
+	if d.MasterKey == "" {
+		keys := make([]string, 0, len(d.directory))
+		for key := range d.directory {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if id := d.directory[key]; d.usableMaster(id) {
+				d.warn("master-key-fallback", -1, fmt.Sprintf("No DSDB key in directory; using %q, block %d, as the master", key, id))
+				return id, nil
+			}
+		}
+	}
+	return 0, &MissingKeyError{Key: d.masterKey()}
+}
+
+// usableMaster reports whether block id could be a master block: it exists
+// within the content and names an existing block as the tree's root.
+func (d *DSStore) usableMaster(id uint32) bool {
+	exists := func(id uint32) bool {
+		return int(id) < len(d.offsets) && d.offsets[id] != 0 && d.blockOffset(d.offsets[id])+20 <= len(d.content)
+	}
+	if !exists(id) {
+		return false
+	}
+	root := binary.BigEndian.Uint32(d.content[d.blockOffset(d.offsets[id]):])
+	return root != id && exists(root)
+}
+
+// allocatorEnd is where the allocator block ends according to the header,
+// clamped to the content so a bogus length cannot widen the bound.
+func (d *DSStore) allocatorEnd() int {
+	end := int64(d.allocatorOffset) + int64(d.allocatorLength)
+	if d.allocatorLength == 0 || end > int64(len(d.content)) {
+		return len(d.content)
+	}
+	return int(end)
+}
+
+// checkCount rejects a count read from the allocator at offset when count
+// elements of elemSize bytes cannot fit between the cursor and the end of
+// the allocator. This stops corrupt or hostile files from forcing huge
+// allocations.
+func (d *DSStore) checkCount(what string, count uint32, offset, elemSize int) error {
+	available := int64(d.allocatorEnd() - d.cursor)
+	if int64(count)*int64(elemSize) > available {
+		return fmt.Errorf("allocator claims %d %s at %#x, but only %d bytes remain", count, what, offset, available)
+	}
+	return nil
+}
+
+// plausibleKeyCount reports whether the uint32 at pos could be the number of
+// table of contents entries: at least one, and every entry (a length byte,
+// a non-empty key and a block ID) fitting in the content.
+func (d *DSStore) plausibleKeyCount(pos int) bool {
+	if pos < 0 || pos+4 > len(d.content) {
+		return false
+	}
+	numKeys := int64(binary.BigEndian.Uint32(d.content[pos : pos+4]))
+	return numKeys > 0 && int64(pos)+4+numKeys*6 <= int64(len(d.content))
+}
+
+func (d *DSStore) parseTreeNode(nodeID uint32, master bool) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > d.stats.MaxDepth {
+		d.stats.MaxDepth = d.depth
+	}
+	if !master {
+		d.stats.Nodes++
+	}
+	d.cursor = d.blockOffset(d.offsets[nodeID])
+
+	if master {
+		d.rootID = d.nextUint32()
+		d.treeHeight = d.nextUint32()
+		d.numRecords = d.nextUint32()
+		d.numNodes = d.nextUint32()
+		switch fifth := d.nextUint32(); {
+		case fifth == pageSize:
+		case plausiblePageSize(fifth):
+			d.warn("master-page-size", d.cursor-4, fmt.Sprintf("Master page size %#x is not Finder's %#x", fifth, pageSize))
+		case d.ValidateMaster:
+			return &MasterBlockError{Value: fifth, Offset: d.cursor - 4}
+		default:
+			d.warn("master-fifth-int", d.cursor-4, fmt.Sprintf("Fifth int of master %x not 0x00001000; the master block may be misplaced", fifth))
+		}
+		return d.parseTreeNode(d.rootID, false)
+	} else {
+		nextID := d.nextUint32()
+		numRecords := d.nextUint32()
+		for i := 0; i < int(numRecords); i++ {
+			if nextID != 0 {
+				// Has children
+				childID := d.nextUint32()
+				currentCursor := d.cursor
+				if err := d.parseTreeNode(childID, false); err != nil {
+					return err
+				}
+				d.cursor = currentCursor
+			}
+			nameLength := d.nextUint32()
+			nameBytes := d.nextBytes(int(nameLength) * 2)
+			name := utf16ToString(nameBytes)
+			if d.PreserveInvalidNames {
+				name = utf16ToWTF8(nameBytes)
+			}
+			if d.NormalizeNames {
+				name = norm.NFC.String(name)
+			}
+			field := string(d.nextBytes(4))
+			valueOffset := d.cursor
+			restore := d.scopeWarnings(name, field)
+			dt, err := d.parseData()
+			restore()
+			if err != nil {
+				var unknown *UnknownTypeError
+				if d.SkipUnknownTypes && errors.As(err, &unknown) {
+					d.warn("unknown-type", unknown.Offset, fmt.Sprintf("%v; skipping the rest of node %d", err, nodeID))
+					return nil
+				}
+				return err
+			}
+
+			raw := rawValue{data: d.content[valueOffset:d.cursor:d.cursor], offset: valueOffset}
+			if err := d.emit(name, field, dt, raw); err != nil {
+				return err
+			}
+		}
+		if nextID != 0 {
+			return d.parseTreeNode(nextID, false)
+		}
+	}
+	return nil
+}
+
+// emit hands one entry of the tree to onEntry, or merges it into the
+// record of the same name.
+func (d *DSStore) emit(name, field string, value interface{}, raw rawValue) error {
+	if d.onEntry != nil {
+		return d.onEntry(name, field, value, raw)
+	}
+	rec := d.record(name)
+	if rec == nil {
+		rec = d.addRecord(name)
+	}
+	d.noteDuplicate(rec, field, value, raw)
+	rec.setRaw(field, value, raw)
+	d.parseEmbedded(rec, field)
+	return nil
+}
+
+// DuplicateField is a field listed more than once for the same record,
+// which Finder never writes. Values are the copies in file order and
+// Offsets where each was stored; the record keeps the last.
+type DuplicateField struct {
+	Record  string
+	Field   string
+	Values  []interface{}
+	Offsets []int
+}
+
+// Differs reports whether the copies disagree, rather than merely repeat.
+func (f DuplicateField) Differs() bool {
+	for _, v := range f.Values[1:] {
+		if !reflect.DeepEqual(v, f.Values[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateFields returns the fields the parsed tree listed more than once
+// for a record, in the order they were found.
+func (d *DSStore) DuplicateFields() []DuplicateField {
+	return d.duplicates
+}
+
+// noteDuplicate records and warns about value when rec already has field,
+// before it replaces the earlier copy.
+func (d *DSStore) noteDuplicate(rec *Record, field string, value interface{}, raw rawValue) {
+	old, ok := rec.fields[field]
+	if !ok {
+		return
+	}
+	var dup *DuplicateField
+	for i := len(d.duplicates) - 1; i >= 0; i-- {
+		if f := &d.duplicates[i]; f.Record == rec.name && f.Field == field {
+			dup = f
+			break
+		}
+	}
+	if dup == nil {
+		d.duplicates = append(d.duplicates, DuplicateField{Record: rec.name, Field: field, Values: []interface{}{old}, Offsets: []int{-1}})
+		dup = &d.duplicates[len(d.duplicates)-1]
+		if r, ok := rec.raw[field]; ok {
+			dup.Offsets[0] = r.offset
+		}
+	}
+	dup.Values = append(dup.Values, value)
+	dup.Offsets = append(dup.Offsets, raw.offset)
+
+	defer d.scopeWarnings(rec.name, field)()
+	if dup.Differs() {
+		d.warn("duplicate-field", raw.offset, fmt.Sprintf("%s of %s appears %d times with differing values; keeping the last", field, rec.name, len(dup.Values)))
+	} else {
+		d.warn("duplicate-field", raw.offset, fmt.Sprintf("%s of %s appears %d times", field, rec.name, len(dup.Values)))
+	}
+}
+
+// record returns the record called name exactly, or nil.
+func (d *DSStore) record(name string) *Record {
+	return d.byName[name]
+}
+
+// addRecord appends an empty record called name.
+func (d *DSStore) addRecord(name string) *Record {
+	rec := NewRecord(name)
+	d.records = append(d.records, rec)
+	if d.byName == nil {
+		d.byName = make(map[string]*Record)
+	}
+	d.byName[name] = rec
+	return rec
+}
+
+// Record returns the record for the file called name. An exact match on
+// the stored name wins. Failing that, names are compared after Unicode NFC
+// normalization, so the composed and decomposed spellings of an accented
+// name (macOS stores the latter) find the same record. Matching is case
+// sensitive, even though Finder treats names case-insensitively.
+func (d *DSStore) Record(name string) (*Record, bool) {
+	if rec := d.record(name); rec != nil {
+		return rec, true
+	}
+	want := norm.NFC.String(name)
+	for _, rec := range d.records {
+		if norm.NFC.String(rec.name) == want {
+			return rec, true
+		}
+	}
+	return nil, false
+}
+
+// MatchMode selects how MatchNames reads its pattern.
+type MatchMode int
+
+const (
+	// MatchGlob reads the pattern as a shell glob, see path.Match, which
+	// must match the whole name.
+	MatchGlob MatchMode = iota
+	// MatchRegexp reads the pattern as a regular expression, which may
+	// match any part of the name unless anchored.
+	MatchRegexp
+)
+
+// MatchNames returns the records whose names match pattern, in record
+// order. A name matches as stored or in Unicode NFC, so a pattern typed
+// with composed accents finds the decomposed names macOS stores.
+func (d *DSStore) MatchNames(pattern string, mode MatchMode) ([]*Record, error) {
+	match, err := nameMatcher(pattern, mode)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*Record
+	for _, rec := range d.records {
+		if match(rec.name) {
+			matched = append(matched, rec)
+		}
+	}
+	return matched, nil
+}
+
+// nameMatcher compiles pattern into a function reporting whether a record
+// name matches it, as MatchNames does.
+func nameMatcher(pattern string, mode MatchMode) (func(name string) bool, error) {
+	var match func(string) bool
+	switch mode {
+	case MatchGlob:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("name pattern %q: %w", pattern, err)
+		}
+		match = func(name string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		}
+	case MatchRegexp:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("name pattern: %w", err)
+		}
+		match = re.MatchString
+	default:
+		return nil, fmt.Errorf("unknown match mode %d", mode)
+	}
+	return func(name string) bool {
+		return match(name) || match(norm.NFC.String(name))
+	}, nil
+}
+
+// parseData reads a four-char data type and its value. Every known type is
+// either fixed-size (bool, shor, long, comp, dutc, type) or length-prefixed
+// (blob, ustr), so known types never need skipping. An unknown type has no
+// size that can be trusted, so parsing cannot resume after it.
+func (d *DSStore) parseData() (interface{}, error) {
+	typeOffset := d.cursor
+	dataType := string(d.nextBytes(4))
+	switch dataType {
+	case "bool":
+		b := d.nextByte()
+		if b > 1 {
+			d.warn("bad-bool", d.cursor-1, fmt.Sprintf("Bool byte %#02x is neither 0 nor 1; reading its low bit", b))
+		}
+		return (b & 0x01) != 0, nil
+	case "shor", "long":
+		// short also uses 4 bytes
+		val := d.nextUint32()
+		return int(val), nil
+	case "comp":
+		val := d.nextUint64()
+		return int64(val), nil
+	case "dutc":
+		// dutc is int 64
+		val := d.nextUint64()
+		return int64(val), nil
+	case "type":
+		tp := d.nextBytes(4)
+		return string(tp), nil
+	case "blob":
+		dataLength := d.nextUint32()
+		return d.nextBytes(int(dataLength)), nil
+	case "ustr":
+		dataLength := d.nextUint32()
+		bytesData := d.nextBytes(int(dataLength * 2))
+		return utf16ToString(bytesData), nil
+	default:
+		return nil, &UnknownTypeError{Type: dataType, Offset: typeOffset}
+	}
+}
+
+// Parse reads the header, allocator and record tree. Records decoded before
+// an error are kept, so callers may still inspect a partially parsed store.
+func (d *DSStore) Parse() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("parsing DS_Store: %v", r)
+		}
+	}()
+	// The header is the magic, the allocator's offset, length and offset
+	// again, and 16 unknown bytes, after the alignment int.
+	minLength := 0x20
+	if !d.alignmentAlreadyStripped {
+		minLength += 4
+	}
+	if len(d.content) < minLength {
+		return fmt.Errorf("%w: %d bytes, need at least %d", ErrTooSmall, len(d.content), minLength)
+	}
+	d.cursor = 0
+	d.stats = ParseStats{}
+	timed := func(phase *time.Duration, parse func() error) error {
+		start := time.Now()
+		defer func() { *phase = time.Since(start) }()
+		return parse()
+	}
+	if err := timed(&d.stats.Header, d.parseHeader); err != nil {
+		return err
+	}
+	// Only Bud1 is known; parseHeader has rejected other versions, so
+	// everything from here on, damaged magics included, is parsed as Bud1.
+	if err := timed(&d.stats.Allocator, d.parseChosenAllocator); err != nil {
+		return err
+	}
+	return timed(&d.stats.Tree, func() error { return d.parseTreeNode(d.masterID, true) })
+}
+
+// ParseStats describes the work done by the last Parse, for diagnosing slow
+// or damaged files. A failed Parse leaves the figures up to the failure.
+type ParseStats struct {
+	// Header, Allocator and Tree are the time spent in each phase.
+	Header, Allocator, Tree time.Duration
+	// Nodes is the number of tree nodes visited and MaxDepth how deeply
+	// the walk recursed, the master block being level 1.
+	Nodes    int
+	MaxDepth int
+	// BytesRead counts the bytes read from the content, those read more
+	// than once included.
+	BytesRead int
+}
+
+// Stats returns the figures of the last Parse.
+func (d *DSStore) Stats() ParseStats {
+	return d.stats
+}
+
+// Stream parses the store in the background and sends each record on the
+// returned channel as soon as its last field has been read, without
+// collecting them in the store. The channel is closed when the tree has
+// been walked, parsing fails or ctx is done; Err then reports why it
+// stopped early.
+//
+// The tree keeps entries sorted by filename, so all fields of a file are
+// adjacent even when they straddle nodes, and each record is sent once
+// with every field. A corrupt, unsorted tree may split a file's fields
+// across several records.
+//
+// Records may be decoded while the stream runs. The parse raises its
+// warnings with the store's own scope, on d.WarningSink or the sink set with
+// SetWarningSink, which must not be changed until the channel is closed.
+func (d *DSStore) Stream(ctx context.Context) <-chan *Record {
+	records := make(chan *Record)
+	go func() {
+		defer close(records)
+		d.streamErr = d.eachRecord(func(r *Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case records <- r:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return records
+}
+
+// eachRecord parses the store and calls fn with each record as soon as its
+// last field has been read, without collecting them in the store, as Stream
+// does but on the caller's goroutine. An error from fn ends the walk and is
+// returned.
+func (d *DSStore) eachRecord(fn func(*Record) error) error {
+	var current *Record
+	d.onEntry = func(name, field string, value interface{}, raw rawValue) error {
+		if current != nil && current.name != name {
+			if err := fn(current); err != nil {
+				return err
+			}
+			current = nil
+		}
+		if current == nil {
+			current = NewRecord(name)
+		}
+		d.noteDuplicate(current, field, value, raw)
+		current.setRaw(field, value, raw)
+		d.parseEmbedded(current, field)
+		return nil
+	}
+	defer func() { d.onEntry = nil }()
+	if err := d.Parse(); err != nil {
+		return err
+	}
+	if current != nil {
+		return fn(current)
+	}
+	return nil
+}
+
+// Err returns the error that ended the last Stream early, if any. It is
+// only meaningful once the stream's channel has been closed.
+func (d *DSStore) Err() error {
+	return d.streamErr
+}
+
+func utf16ToString(b []byte) string {
+	if len(b)%2 != 0 {
+		return ""
+	}
+	u := make([]uint16, len(b)/2)
+	for i := 0; i < len(b); i += 2 {
+		u[i/2] = binary.BigEndian.Uint16(b[i : i+2])
+	}
+	runes := utf16.Decode(u)
+	return string(runes)
+}
+
+// utf16ToWTF8 is utf16ToString except that an unpaired surrogate, which that
+// turns into U+FFFD, is kept as the three bytes UTF-8 would give its code
+// point. This is the WTF-8 encoding; stringToUTF16 reverses it exactly.
+func utf16ToWTF8(b []byte) string {
+	if len(b)%2 != 0 {
+		return ""
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i += 2 {
+		u := rune(binary.BigEndian.Uint16(b[i:]))
+		if utf16.IsSurrogate(u) && i+4 <= len(b) {
+			if r := utf16.DecodeRune(u, rune(binary.BigEndian.Uint16(b[i+2:]))); r != utf8.RuneError {
+				out = utf8.AppendRune(out, r)
+				i += 2
+				continue
+			}
+		}
+		if utf16.IsSurrogate(u) {
+			// utf8.AppendRune refuses surrogates, so encode by hand.
+			out = append(out, 0xe0|byte(u>>12), 0x80|byte(u>>6)&0x3f, 0x80|byte(u)&0x3f)
+			continue
+		}
+		out = utf8.AppendRune(out, u)
+	}
+	return string(out)
+}
+
+// stringToUTF16 encodes s as UTF-16, turning WTF-8 surrogates back into the
+// lone units they stand for. Other invalid bytes become U+FFFD.
+func stringToUTF16(s string) []uint16 {
+	var units []uint16
+	for i := 0; i < len(s); {
+		if i+2 < len(s) && s[i] == 0xed && s[i+1]&0xe0 == 0xa0 && s[i+2]&0xc0 == 0x80 {
+			units = append(units, 0xd000|uint16(s[i+1]&0x3f)<<6|uint16(s[i+2]&0x3f))
+			i += 3
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		units = utf16.AppendRune(units, r)
+		i += size
+	}
+	return units
 }
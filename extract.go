@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// extractPlists writes every embedded property list in ds to its own file
+// in dir, named <record>.<field>.plist. Records whose names are spelled the
+// same once made safe, such as "a/b" and "a_b", have the later files
+// numbered <record>.<field>.2.plist and so on, so none overwrites another.
+// The raw bytes are written as stored unless asXML is set, in which case
+// each plist is re-encoded as XML. It returns the paths written.
+func extractPlists(ds *DSStore, dir string, asXML bool) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	var written []string
+	used := make(map[string]bool)
+	for _, r := range ds.readRecords() {
+		fields := make([]string, 0, len(r.fields))
+		for field := range r.fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			data, ok := r.plistData(field)
+			if !ok {
+				continue
+			}
+			if asXML {
+				var v interface{}
+				if _, err := plist.Unmarshal(data, &v); err != nil {
+					return written, fmt.Errorf("%s %s: %w", r.name, field, err)
+				}
+				xml, err := plist.MarshalIndent(v, plist.XMLFormat, "\t")
+				if err != nil {
+					return written, fmt.Errorf("%s %s: %w", r.name, field, err)
+				}
+				data = xml
+			}
+			base := plistFileName(r.name, field)
+			name := base + ".plist"
+			for n := 2; used[name]; n++ {
+				name = fmt.Sprintf("%s.%d.plist", base, n)
+			}
+			used[name] = true
+			name = filepath.Join(dir, name)
+			if err := os.WriteFile(name, data, 0o644); err != nil {
+				return written, err
+			}
+			written = append(written, name)
+		}
+	}
+	return written, nil
+}
+
+// plistFileName builds the output name for a record's plist field, without
+// the .plist extension. Record names are untrusted, so path separators are
+// replaced and the names "." and ".." (the former being the directory's own
+// record) are spelled out.
+func plistFileName(record, field string) string {
+	switch record {
+	case ".":
+		record = "_dot"
+	case "..":
+		record = "_dotdot"
+	default:
+		record = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(record)
+	}
+	return record + "." + field
+}
@@ -2,4 +2,7 @@ module github.com/Yukaii/ds-store-parser
 
 go 1.23.4
 
-require howett.net/plist v1.0.1 // indirect
+require (
+	golang.org/x/text v0.28.0
+	howett.net/plist v1.0.1
+)
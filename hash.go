@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+)
+
+// VolatileFields are the field codes StableHash ignores unless
+// HashIgnoredFields says otherwise: modification timestamps, which Finder
+// rewrites without anything visible changing, and the icon and list view
+// scroll positions.
+var VolatileFields = map[string]bool{
+	"moDD": true,
+	"modD": true,
+	"dutc": true,
+	"icsp": true,
+	"lssp": true,
+}
+
+// StableHash returns a hex SHA-256 digest of the store's records that
+// ignores the fields in HashIgnoredFields, or VolatileFields when that is
+// nil. Two stores with the same names and the same remaining values hash
+// alike even if their trees are laid out differently, their records are in
+// another order or a value is stored as a different but equivalent data
+// type (shor and long, say).
+func (d *DSStore) StableHash() string {
+	ignore := d.HashIgnoredFields
+	if ignore == nil {
+		ignore = VolatileFields
+	}
+	records := append([]*Record(nil), d.records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].name < records[j].name })
+
+	h := sha256.New()
+	// Every string and value is length-prefixed so adjacent ones cannot
+	// run into each other.
+	write := func(b []byte) {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+		h.Write(b)
+	}
+	for _, r := range records {
+		var fields []string
+		for field := range r.fields {
+			if !ignore[field] {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		write([]byte(r.name))
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(fields))))
+		for _, field := range fields {
+			value, err := encodeValue(r.fields[field])
+			if err != nil {
+				// Parsed values always encode; anything else is hashed by
+				// its Go representation rather than dropped.
+				value = []byte(showOne(r.fields[field]))
+			}
+			write([]byte(field))
+			write(value)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WindowInfo is the structured form of fwi0: the Finder window rectangle in
+// screen coordinates, the view style it opens in and whether its toolbar is
+// shown.
+type WindowInfo struct {
+	Top            int       `json:"top"`
+	Left           int       `json:"left"`
+	Bottom         int       `json:"bottom"`
+	Right          int       `json:"right"`
+	ViewStyle      ViewStyle `json:"viewStyle"`
+	ToolbarVisible bool      `json:"toolbarVisible"`
+}
+
+// IconLocation is the structured form of Iloc, in Finder window
+// coordinates. Index is the icon's manual sort order, and nil when Finder
+// auto-arranges it.
+type IconLocation struct {
+	X     int  `json:"x"`
+	Y     int  `json:"y"`
+	Index *int `json:"index,omitempty"`
+}
+
+// Background is the structured form of BKGD. Type is one of the codes of
+// BackgroundTypes; Color is "#rrrrggggbbbb" and only set for "ClrB".
+type Background struct {
+	Type  string `json:"type"`
+	Color string `json:"color,omitempty"`
+}
+
+// DateField is the structured form of a moDD or modD timestamp. Seconds is
+// the value as stored, in seconds since the 1904 Mac epoch.
+type DateField struct {
+	Time    time.Time `json:"time"`
+	Seconds float64   `json:"seconds"`
+}
+
+// recordJSON is the structured form of a Record. Source is only filled in
+// when records from several files share one output stream. The well-known
+// fields that decode cleanly get typed members; every other field, and any
+// well-known one too short or of the wrong type, stays in Fields.
+type recordJSON struct {
+	Source string `json:"source,omitempty"`
+	Name   string `json:"name"`
+	// DirectorySettings marks the "." record, see IsDirectorySettings.
+	DirectorySettings bool `json:"directorySettings,omitempty"`
+
+	Window           *WindowInfo   `json:"window,omitempty"`
+	IconLocation     *IconLocation `json:"iconLocation,omitempty"`
+	Background       *Background   `json:"background,omitempty"`
+	View             *ViewSettings `json:"view,omitempty"`
+	ModificationDate *DateField    `json:"modificationDate,omitempty"`
+	// ModificationDateAlt is modD, a second timestamp of unclear purpose.
+	ModificationDateAlt *DateField `json:"modificationDateAlt,omitempty"`
+
+	Fields map[string]interface{} `json:"fields"`
+	// Offsets locates each field's stored value, with --offsets.
+	Offsets map[string]fieldOffset `json:"offsets,omitempty"`
+}
+
+func (r *Record) jsonValue() recordJSON {
+	v := recordJSON{Name: r.name, DirectorySettings: r.IsDirectorySettings()}
+	typed := make(map[string]bool)
+	settings := r.ViewSettings()
+	if settings.HasWindow {
+		v.Window = &WindowInfo{
+			Top:            settings.Window.Min.Y,
+			Left:           settings.Window.Min.X,
+			Bottom:         settings.Window.Max.Y,
+			Right:          settings.Window.Max.X,
+			ViewStyle:      ViewStyle(r.fields["fwi0"].([]byte)[8:12]),
+			ToolbarVisible: settings.ToolbarVisible,
+		}
+		typed["fwi0"] = true
+	}
+	if b, ok := r.fields["Iloc"].([]byte); ok && len(b) >= 8 {
+		x, y := ilocPosition(b)
+		v.IconLocation = &IconLocation{X: x, Y: y}
+		if index, ok := ilocIndex(b); ok {
+			v.IconLocation.Index = &index
+		}
+		typed["Iloc"] = true
+	}
+	if settings.HasBackground {
+		v.Background = &Background{Type: settings.Background}
+		if settings.Background == "ClrB" {
+			c := settings.BackgroundColor
+			v.Background.Color = fmt.Sprintf("#%04x%04x%04x", c[0], c[1], c[2])
+		}
+		typed["BKGD"] = true
+	}
+	if _, ok := r.fields["vstl"].(string); ok {
+		typed["vstl"] = true
+	}
+	if settings.Version != nil {
+		typed["vSrn"] = true
+	}
+	if settings.HasIconView {
+		typed["icvo"] = true
+	}
+	if settings.HasListView {
+		typed["lsvo"] = true
+	}
+	if typed["vstl"] || typed["vSrn"] || typed["icvo"] || typed["lsvo"] {
+		v.View = &settings
+	}
+	v.ModificationDate = r.dateField("moDD", typed)
+	v.ModificationDateAlt = r.dateField("modD", typed)
+
+	v.Fields = make(map[string]interface{}, len(r.fields))
+	for field := range r.fields {
+		if at, ok := r.fieldOffset(field); ok {
+			if v.Offsets == nil {
+				v.Offsets = make(map[string]fieldOffset)
+			}
+			v.Offsets[field] = at
+		}
+		if typed[field] {
+			continue
+		}
+		// Embedded property lists are more useful decoded than as base64.
+		v.Fields[field] = r.Decode(field)
+	}
+	return v
+}
+
+// dateField returns the timestamp field as a DateField, marking it in typed,
+// or nil when the record lacks it or its format is not recognized.
+func (r *Record) dateField(field string, typed map[string]bool) *DateField {
+	seconds, ok := macDateSeconds(r.fields[field])
+	if !ok {
+		return nil
+	}
+	typed[field] = true
+	return &DateField{Time: macEpochTime(seconds), Seconds: seconds}
+}
+
+// MarshalJSON encodes the record as {"name": ..., "fields": {...}}, with
+// the well-known fields lifted out into typed members such as "window" and
+// "iconLocation". Raw byte fields become base64 strings, as encoding/json
+// does for []byte.
+func (r *Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.jsonValue())
+}
+
+// writeNDJSON emits one JSON object per line for every record of ds, each
+// tagged with the path of the file it came from.
+func writeNDJSON(w io.Writer, source string, ds *DSStore) error {
+	enc := json.NewEncoder(w)
+	for _, r := range ds.readRecords() {
+		v := r.jsonValue()
+		v.Source = source
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonStream writes the --format json document for one file a record at a
+// time, so the records need not all be held at once. The output is what
+// encoding the whole document with two-space indentation gives: its
+// source, its records and the warnings raised while reading them.
+type jsonStream struct {
+	w      io.Writer
+	source string
+	buf    bytes.Buffer
+	enc    *json.Encoder
+	n      int
+}
+
+func newJSONStream(w io.Writer, source string) *jsonStream {
+	s := &jsonStream{w: w, source: source}
+	s.enc = json.NewEncoder(&s.buf)
+	return s
+}
+
+// encode renders v at the given indentation into s.buf, without the
+// trailing newline.
+func (s *jsonStream) encode(v interface{}, prefix string) ([]byte, error) {
+	s.buf.Reset()
+	s.enc.SetIndent(prefix, "  ")
+	if err := s.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(s.buf.Bytes(), []byte("\n")), nil
+}
+
+// record writes r as the next element of the records array, opening the
+// document before the first.
+func (s *jsonStream) record(r *Record) error {
+	sep := ",\n    "
+	if s.n == 0 {
+		source, err := s.encode(s.source, "")
+		if err != nil {
+			return err
+		}
+		sep = fmt.Sprintf("{\n  \"source\": %s,\n  \"records\": [\n    ", source)
+	}
+	b, err := s.encode(r, "    ")
+	if err != nil {
+		return err
+	}
+	s.n++
+	if _, err := io.WriteString(s.w, sep); err != nil {
+		return err
+	}
+	_, err = s.w.Write(b)
+	return err
+}
+
+// close ends the document with warnings.
+func (s *jsonStream) close(warnings []Warning) error {
+	var head string
+	if s.n == 0 {
+		source, err := s.encode(s.source, "")
+		if err != nil {
+			return err
+		}
+		head = fmt.Sprintf("{\n  \"source\": %s,\n  \"records\": [],\n", source)
+	} else {
+		head = "\n  ],\n"
+	}
+	if warnings == nil {
+		warnings = []Warning{}
+	}
+	b, err := s.encode(warnings, "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "%s  \"warnings\": %s\n}\n", head, b)
+	return err
+}
+
+// writeJSON emits one indented JSON document describing ds and the warnings
+// raised while parsing and decoding it.
+func writeJSON(w io.Writer, source string, ds *DSStore, warnings []Warning) error {
+	s := newJSONStream(w, source)
+	for _, r := range ds.readRecords() {
+		if err := s.record(r); err != nil {
+			return err
+		}
+	}
+	return s.close(warnings)
+}
@@ -1,38 +1,704 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 )
 
-func main() {
-	args := os.Args
-	filename := ".DS_Store"
-	if len(args) == 2 {
-		filename = args[1]
-	} else if len(args) > 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <.DS_Store file>\n", args[0])
-		os.Exit(1)
-	} else {
+// inputPaths expands the command-line arguments into the files to parse. A
+// directory argument is walked for every .DS_Store file beneath it.
+func inputPaths(args []string) ([]string, error) {
+	if len(args) == 0 {
 		fmt.Fprintf(os.Stderr, "File unspecified. Using .DS_Store in the current directory...\n")
+		return []string{".DS_Store"}, nil
+	}
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			// Unreadable paths are reported when they fail to open, so
+			// one bad argument doesn't stop the others.
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && entry.Name() == ".DS_Store" {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
+	return paths, nil
+}
 
-	content, err := ioutil.ReadFile(filename)
+// cliOptions holds the flags that affect how each file is processed.
+type cliOptions struct {
+	format string
+	sort   string
+	strict bool
+	// offset is where the store starts within each file.
+	offset int
+	// nfc normalizes record names to NFC.
+	nfc bool
+	// template, when set, replaces the text output with one execution
+	// per record.
+	template *template.Template
+	// onlyAnomalies drops records that raised no warnings.
+	onlyAnomalies bool
+	// summary replaces the text output with field statistics.
+	summary bool
+	// allocatorOffset picks between disagreeing header allocator offsets.
+	allocatorOffset AllocatorOffsetChoice
+	// debug prints parse timings and counts to stderr.
+	debug bool
+	// names, when set, keeps only the records whose names it accepts.
+	names func(name string) bool
+	// embeddedDepth is how many levels of stores nested in blob fields
+	// are parsed, see DSStore.EmbeddedDepth.
+	embeddedDepth int
+}
+
+// processFile parses one store and writes it to w in the requested format.
+// multiple is set when several files share the output, so text output gets
+// a per-file header.
+func processFile(w io.Writer, filename string, opts cliOptions, multiple bool) error {
+	var collector *warningCollector
+	if opts.format == "json" {
+		collector = &warningCollector{}
+		defer SetWarningSink(SetWarningSink(collector))
+	}
+	var strict *strictSink
+	if opts.strict {
+		strict = &strictSink{next: warningSink}
+		defer SetWarningSink(SetWarningSink(strict))
+	} else {
+		defer SetWarningSink(SetWarningSink(quietSink{next: warningSink, codes: strictOnlyCodes}))
+	}
+	var anomalies *anomalySink
+	if opts.onlyAnomalies {
+		anomalies = &anomalySink{next: warningSink}
+		defer SetWarningSink(SetWarningSink(anomalies))
+	}
+
+	// --sort needs every record before the first can be written.
+	if opts.format == "json" && opts.sort == "" {
+		if err := streamJSON(w, filename, opts, collector, anomalies); err != nil {
+			return err
+		}
+		return strict.err(filename)
+	}
+
+	ds, err := parseFile(filename, opts)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if opts.names != nil {
+		var kept []*Record
+		for _, r := range ds.records {
+			if opts.names(r.name) {
+				kept = append(kept, r)
+			}
+		}
+		ds.records = kept
 	}
 
+	if opts.sort != "" {
+		key := strings.TrimPrefix(opts.sort, "-")
+		if err := sortRecords(ds.records, key, key != opts.sort); err != nil {
+			return err
+		}
+	}
+
+	// Formats other than text never render the fields, but decoding them is
+	// what validates them, so do it whenever the warnings are wanted.
+	// --only-anomalies needs them before any record is written.
+	rendersText := opts.format == "text" && opts.template == nil && !opts.summary
+	if opts.format == "json" || opts.onlyAnomalies || opts.strict && !rendersText {
+		for _, r := range ds.readRecords() {
+			r.humanReadable()
+		}
+	}
+	if anomalies != nil {
+		var kept []*Record
+		for _, r := range ds.records {
+			if anomalies.anomalous(r.name) {
+				kept = append(kept, r)
+			}
+		}
+		ds.records = kept
+		// The kept records were already decoded above, so rendering them
+		// again must not repeat their warnings.
+		defer SetWarningSink(SetWarningSink(discardSink{}))
+	}
+
+	// A store without anomalies is left out entirely, except in json where
+	// every input gets a document.
+	quiet := anomalies != nil && len(ds.records) == 0 && opts.format != "json"
+	switch {
+	case quiet:
+	case opts.format == "json":
+		err = writeJSON(w, filename, ds, collector.warnings)
+	case opts.format == "ndjson":
+		err = writeNDJSON(w, filename, ds)
+	case opts.format == "raw":
+		if multiple {
+			fmt.Fprintf(w, "==> %s <==\n", filename)
+		}
+		writeRaw(w, ds)
+	case opts.template != nil:
+		err = writeTemplate(w, filename, ds, opts.template)
+	default:
+		if multiple {
+			fmt.Fprintf(w, "==> %s <==\n", filename)
+		}
+		if opts.summary {
+			writeStoreSummary(w, ds)
+		} else {
+			writeHumanReadable(w, ds)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return strict.err(filename)
+}
+
+// streamJSON writes the json document for filename while parsing it: each
+// record is decoded and written as soon as it has been read, and then
+// dropped, so memory stays flat however large the store. A parse error
+// after the first record still ends the document, with the records read
+// until then, before it is returned.
+func streamJSON(w io.Writer, filename string, opts cliOptions, collector *warningCollector, anomalies *anomalySink) error {
+	ds, err := openFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	s := newJSONStream(w, filename)
+	failed := false
+	err = ds.eachRecord(func(r *Record) error {
+		if opts.names != nil && !opts.names(r.name) {
+			return nil
+		}
+		// Decoding validates the fields, so the record's warnings are
+		// known before it is written.
+		r.humanReadable()
+		if anomalies != nil && !anomalies.anomalous(r.name) {
+			return nil
+		}
+		if err := s.record(r); err != nil {
+			failed = true
+			return err
+		}
+		return nil
+	})
+	if opts.debug {
+		writeDebug(os.Stderr, filename, ds)
+	}
+	if failed {
+		return err
+	}
+	if err != nil {
+		err = fmt.Errorf("parsing %s: %w", filename, err)
+		if s.n == 0 {
+			return err
+		}
+	}
+	if closeErr := s.close(collector.warnings); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// parseFile reads and parses the store at filename, see openFile.
+func parseFile(filename string, opts cliOptions) (*DSStore, error) {
+	ds, err := openFile(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = ds.Parse()
+	if opts.debug {
+		writeDebug(os.Stderr, filename, ds)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return ds, nil
+}
+
+// writeDebug prints the parse statistics of ds for --debug.
+func writeDebug(w io.Writer, filename string, ds *DSStore) {
+	s := ds.Stats()
+	fmt.Fprintf(w, "Debug: %s: header %v, allocator %v, tree %v; %d nodes, max depth %d, %d bytes read\n",
+		filename, s.Header, s.Allocator, s.Tree, s.Nodes, s.MaxDepth, s.BytesRead)
+}
+
+// openFile reads the store at filename, set up with the options but not yet
+// parsed. A non-zero offset skips wrapper bytes before the store, which must
+// then start with a valid header.
+func openFile(filename string, opts cliOptions) (*DSStore, error) {
+	offset := opts.offset
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 	ds := NewDSStore(content)
-	if err := ds.Parse(); err != nil {
-		log.Fatal(err)
+	if offset != 0 {
+		if offset < 0 || offset > len(content) {
+			return nil, fmt.Errorf("%s: offset %d outside file of %d bytes", filename, offset, len(content))
+		}
+		ds, err = NewDSStoreFromSlice(content, offset, len(content)-offset)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	ds.NormalizeNames = opts.nfc
+	ds.AllocatorOffset = opts.allocatorOffset
+	ds.EmbeddedDepth = opts.embeddedDepth
+	return ds, nil
+}
+
+// writeTree reconstructs the directory tree listed by all the stores in
+// paths, keyed by the directory each one was found in.
+func writeTree(w io.Writer, paths []string, opts cliOptions, asJSON bool) (failed int, err error) {
+	stores := make(map[string]*DSStore)
+	for _, filename := range paths {
+		ds, err := parseFile(filename, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		stores[filepath.Dir(filename)] = ds
+	}
+	tree := ReconstructTree(stores)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return failed, enc.Encode(tree)
 	}
+	writeTreeListing(w, tree)
+	return failed, nil
+}
 
+// writeCounts prints how many records each store holds, counted by parsing
+// it rather than read from its header: a bare number for a single file, or
+// "count<TAB>path" lines and a total for several. It returns how many files
+// failed to parse.
+func writeCounts(w io.Writer, paths []string, opts cliOptions) (failed int) {
+	total := 0
+	for _, filename := range paths {
+		ds, err := parseFile(filename, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		n := 0
+		for _, r := range ds.readRecords() {
+			if opts.names == nil || opts.names(r.name) {
+				n++
+			}
+		}
+		total += n
+		if len(paths) == 1 {
+			fmt.Fprintln(w, n)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\n", n, filename)
+		}
+	}
+	if len(paths) > 1 {
+		fmt.Fprintf(w, "%d\ttotal\n", total)
+	}
+	return failed
+}
+
+// writeHumanReadable prints every record of ds followed by its decoded fields.
+func writeHumanReadable(w io.Writer, ds *DSStore) {
 	for _, record := range ds.readRecords() {
-		fmt.Println(record.name)
+		name := record.name
+		if render.color {
+			name = colorize(sgrBold, name)
+		}
+		if record.IsDirectorySettings() {
+			name += " (this directory's settings)"
+		}
+		fmt.Fprintln(w, name)
 		for _, line := range record.humanReadable() {
-			fmt.Printf("\t%s\n", line)
+			if render.color {
+				line = colorLine(line)
+			}
+			fmt.Fprintln(w, indentLine(line, 1))
+		}
+	}
+}
+
+// writeRaw prints every record of ds with each field as its code, data type
+// and payload bytes in hex, exactly as stored and without any decoding.
+func writeRaw(w io.Writer, ds *DSStore) {
+	for _, record := range ds.readRecords() {
+		fmt.Fprintln(w, record.name)
+		for _, field := range record.order {
+			raw, ok := record.raw[field]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %s %s\n", render.indent, field, raw.data[:4], hex.EncodeToString(raw.data[4:]))
+		}
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run is main with an exit status, so deferred cleanups like the warning
+// summary still happen. args excludes the program name.
+func run(args []string, stdout, stderr *os.File) int {
+	if len(args) > 0 && args[0] == "extract-plists" {
+		return runExtractPlists(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "audit" {
+		return runAudit(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "sanitize" {
+		return runSanitize(args[1:], stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	bytesFlag := flags.String("bytes", "hex", "encoding for raw byte fields: hex or base64")
+	sortFlag := flags.String("sort", "", "sort records by name, fields or size; prefix with - for descending")
+	versionFlag := flags.Bool("version", false, "print version information and exit")
+	formatFlag := flags.String("format", "text", "output format: text, json, ndjson, raw (undecoded type and bytes per field), or tree/tree-json for a directory tree across all files")
+	colorFlag := flags.String("color", "auto", "colorize text output: auto, always or never")
+	strictFlag := flags.Bool("strict", false, "fail on any unrecognized field, value or data type")
+	anomaliesFlag := flags.Bool("only-anomalies", false, "print only the records that raised a warning while decoding")
+	offsetFlag := flags.Int("offset", 0, "byte offset of the store within each file, for prefixed or carved data")
+	hexIntsFlag := flags.Bool("hex-ints", false, "print integer field values in hexadecimal")
+	rawPlistsFlag := flags.Bool("raw-plists", false, "dump list view property lists as generic plists instead of a column table")
+	volumeFlag := flags.String("volume", "", "mount point to resolve Trash put-back locations (ptbL) against, e.g. / or /Volumes/Backup")
+	followEmbeddedFlag := flags.Bool("follow-embedded", true, "parse and show stores embedded in blob fields")
+	embeddedDepthFlag := flags.Int("embedded-depth", 4, "how many levels of embedded stores to expand with --follow-embedded")
+	allocatorFlag := flags.String("allocator-offset", "auto", "which header allocator offset to use when the two differ: auto, first or second")
+	offsetsFlag := flags.Bool("offsets", false, "annotate each field with @offset+length of its stored value in the file")
+	indentFlag := flags.String("indent", "tab", "indentation per nesting level in text output: tab, or a number of spaces")
+	nfcFlag := flags.Bool("nfc", false, "normalize filenames to Unicode NFC instead of printing them as stored")
+	countFlag := flags.Bool("count", false, "print only the number of records per file, and a total for several files")
+	summaryFlag := flags.Bool("summary", false, "print record counts and how many records carry each field instead of the records")
+	templateFlag := flags.String("template", "", "Go text/template executed per record instead of the text output")
+	namePatternFlag := flags.String("name-pattern", "", "show only the records whose names match this pattern, e.g. '*.key'")
+	nameMatchFlag := flags.String("name-match", "glob", "how --name-pattern is read: glob or regexp")
+	debugFlag := flags.Bool("debug", false, "print parse timings, nodes visited, recursion depth and bytes read per file to stderr")
+	dedupeFlag := flags.Int("dedupe-warnings", 0, "print each distinct warning at most N times, then a count (0 prints all)")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [options] [.DS_Store file or directory...]\n", os.Args[0])
+		fmt.Fprintf(stderr, "       %s extract-plists [options] file outdir\n", os.Args[0])
+		fmt.Fprintf(stderr, "       %s audit --expect spec.json [options] [file or directory...]\n", os.Args[0])
+		fmt.Fprintf(stderr, "       %s sanitize [options] in out\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *versionFlag {
+		fmt.Fprintln(stdout, versionString())
+		return 0
+	}
+
+	switch *bytesFlag {
+	case "hex", "base64":
+		render.bytesEncoding = *bytesFlag
+	default:
+		fmt.Fprintf(stderr, "Unknown --bytes encoding %q (want hex or base64)\n", *bytesFlag)
+		return 1
+	}
+
+	if *indentFlag != "tab" {
+		n, err := strconv.Atoi(*indentFlag)
+		if err != nil || n < 0 {
+			fmt.Fprintf(stderr, "Unknown --indent %q (want tab or a number of spaces)\n", *indentFlag)
+			return 1
 		}
+		render.indent = strings.Repeat(" ", n)
+	}
+
+	render.volume = *volumeFlag
+	render.rawPlists = *rawPlistsFlag
+	render.hexInts = *hexIntsFlag
+	render.offsets = *offsetsFlag
+	render.offsetBase = *offsetFlag
+
+	switch *colorFlag {
+	case "auto", "always", "never":
+		render.color = colorEnabled(*colorFlag, stdout)
+		SetWarningSink(stderrSink{w: stderr, color: colorEnabled(*colorFlag, stderr)})
+	default:
+		fmt.Fprintf(stderr, "Unknown --color mode %q (want auto, always or never)\n", *colorFlag)
+		return 1
+	}
+
+	switch *formatFlag {
+	case "text", "json", "ndjson", "raw", "tree", "tree-json":
+	default:
+		fmt.Fprintf(stderr, "Unknown --format %q (want text, json, ndjson, raw, tree or tree-json)\n", *formatFlag)
+		return 1
+	}
+
+	if *summaryFlag && (*formatFlag != "text" || *templateFlag != "") {
+		fmt.Fprintf(stderr, "--summary only works with the text format\n")
+		return 1
+	}
+
+	if *countFlag && (*formatFlag != "text" || *templateFlag != "" || *summaryFlag) {
+		fmt.Fprintf(stderr, "--count only works with the text format\n")
+		return 1
+	}
+
+	var tmpl *template.Template
+	if *templateFlag != "" {
+		if *formatFlag != "text" {
+			fmt.Fprintf(stderr, "--template cannot be combined with --format %s\n", *formatFlag)
+			return 1
+		}
+		var err error
+		if tmpl, err = parseTemplate(*templateFlag); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	if *dedupeFlag > 0 {
+		dedupe := newDedupeSink(warningSink, *dedupeFlag)
+		SetWarningSink(dedupe)
+		defer dedupe.writeSummary(stderr)
+	}
+
+	paths, err := inputPaths(flags.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	opts := cliOptions{format: *formatFlag, sort: *sortFlag, strict: *strictFlag, offset: *offsetFlag, nfc: *nfcFlag, template: tmpl, onlyAnomalies: *anomaliesFlag, summary: *summaryFlag, debug: *debugFlag, embeddedDepth: *embeddedDepthFlag}
+	if !*followEmbeddedFlag {
+		opts.embeddedDepth = 0
+	}
+	switch *allocatorFlag {
+	case "auto":
+	case "first":
+		opts.allocatorOffset = AllocatorOffsetFirst
+	case "second":
+		opts.allocatorOffset = AllocatorOffsetSecond
+	default:
+		fmt.Fprintf(stderr, "Unknown --allocator-offset %q (want auto, first or second)\n", *allocatorFlag)
+		return 1
+	}
+	if *namePatternFlag != "" {
+		mode := MatchGlob
+		switch *nameMatchFlag {
+		case "glob":
+		case "regexp":
+			mode = MatchRegexp
+		default:
+			fmt.Fprintf(stderr, "Unknown --name-match %q (want glob or regexp)\n", *nameMatchFlag)
+			return 1
+		}
+		if opts.names, err = nameMatcher(*namePatternFlag, mode); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	if *formatFlag == "tree" || *formatFlag == "tree-json" {
+		failed, err := writeTree(stdout, paths, opts, *formatFlag == "tree-json")
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if *countFlag {
+		if writeCounts(stdout, paths, opts) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	failed := 0
+	for _, filename := range paths {
+		if err := processFile(stdout, filename, opts, len(paths) > 1); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runExtractPlists implements the extract-plists subcommand, which writes
+// each embedded property list of one store to a file of its own.
+func runExtractPlists(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("extract-plists", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	xmlFlag := flags.Bool("xml", false, "re-encode each plist as XML instead of writing the stored bytes")
+	offsetFlag := flags.Int("offset", 0, "byte offset of the store within the file")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s extract-plists [options] file outdir\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	ds, err := parseFile(flags.Arg(0), cliOptions{offset: *offsetFlag})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	written, err := extractPlists(ds, flags.Arg(1), *xmlFlag)
+	for _, name := range written {
+		fmt.Fprintln(stdout, name)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runAudit implements the audit subcommand, which checks the folder
+// settings of each store against an expected spec. It exits 1 when any
+// store deviates or fails to parse.
+func runAudit(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	expectFlag := flags.String("expect", "", "JSON file with the expected settings: viewStyle, iconSize, arrangeBy, labelPosition, background")
+	offsetFlag := flags.Int("offset", 0, "byte offset of the store within each file")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s audit --expect spec.json [options] [file or directory...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if *expectFlag == "" {
+		flags.Usage()
+		return 2
+	}
+
+	f, err := os.Open(*expectFlag)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	spec, err := readSettingsSpec(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s: %v\n", *expectFlag, err)
+		return 1
+	}
+	paths, err := inputPaths(flags.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, filename := range paths {
+		ds, err := parseFile(filename, cliOptions{offset: *offsetFlag})
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		if writeAudit(stdout, filename, ds, spec) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runSanitize implements the sanitize subcommand, which writes a copy of
+// one store with only the chosen fields of the folder's own settings.
+func runSanitize(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sanitize", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keepFlag := flags.String("keep", "", "comma-separated field codes to keep (default: the view style, window, background and view option fields)")
+	keepNamesFlag := flags.Bool("keep-names", false, "keep the kept fields of every record, not just the folder's own settings")
+	offsetFlag := flags.Int("offset", 0, "byte offset of the store within the file")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s sanitize [options] in out\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	var keep map[string]bool
+	if *keepFlag != "" {
+		keep = make(map[string]bool)
+		for _, field := range strings.Split(*keepFlag, ",") {
+			if field = strings.TrimSpace(field); len(field) != 4 {
+				fmt.Fprintf(stderr, "Error: --keep: field code %q is not four bytes\n", field)
+				return 1
+			}
+			keep[field] = true
+		}
+	}
+	ds, err := parseFile(flags.Arg(0), cliOptions{offset: *offsetFlag})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	out, err := Sanitize(ds, keep, *keepNamesFlag).Encode()
+	if err == nil {
+		err = os.WriteFile(flags.Arg(1), out, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+)
+
+// MergePolicy decides whose value MergeStores keeps when both stores have
+// the same field of the same record with different values.
+type MergePolicy int
+
+const (
+	// PreferA keeps the first store's value.
+	PreferA MergePolicy = iota
+	// PreferB keeps the second store's value.
+	PreferB
+	// PreferNewer keeps the value from the record with the later
+	// modification date, moDD or else modD. Ties, and records where either
+	// side has no date, go to the first store.
+	PreferNewer
+)
+
+// MergeConflict is a field the two stores disagreed on.
+type MergeConflict struct {
+	Record string
+	Field  string
+	A, B   interface{}
+	// FromB is set when the second store's value was kept.
+	FromB bool
+}
+
+// MergeStores returns a new store with the union of a's and b's records,
+// matched by name, and of their fields, for piecing together a folder's
+// settings from stores recovered at different times. Fields only one side
+// has are copied as they are; differing values are settled by policy and
+// listed in the returned conflicts, in record and field order. The merged
+// records keep their original encodings and are in tree order, so Encode
+// writes the result as a fresh store. Neither input is modified.
+func MergeStores(a, b *DSStore, policy MergePolicy) (*DSStore, []MergeConflict) {
+	merged := NewDSStore(nil)
+	for _, r := range a.records {
+		copyFields(merged.mergedRecord(r.name), r, nil)
+	}
+
+	var conflicts []MergeConflict
+	for _, rb := range b.records {
+		ra := a.record(rb.name)
+		if ra == nil {
+			copyFields(merged.mergedRecord(rb.name), rb, nil)
+			continue
+		}
+		preferB := policy == PreferB
+		if policy == PreferNewer {
+			ta, okA := recordDate(ra)
+			tb, okB := recordDate(rb)
+			preferB = okA && okB && tb > ta
+		}
+		fields := make([]string, 0, len(rb.fields))
+		for field := range rb.fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		take := make(map[string]bool)
+		for _, field := range fields {
+			va, ok := ra.fields[field]
+			switch {
+			case !ok:
+				take[field] = true
+			case !reflect.DeepEqual(va, rb.fields[field]):
+				conflicts = append(conflicts, MergeConflict{Record: rb.name, Field: field, A: va, B: rb.fields[field], FromB: preferB})
+				take[field] = preferB
+			}
+		}
+		copyFields(merged.record(rb.name), rb, take)
+	}
+
+	sort.SliceStable(merged.records, func(i, j int) bool {
+		return compareNames(merged.records[i].name, merged.records[j].name) < 0
+	})
+	return merged, conflicts
+}
+
+// mergedRecord returns the record called name, adding it if needed.
+func (d *DSStore) mergedRecord(name string) *Record {
+	if r := d.record(name); r != nil {
+		return r
+	}
+	return d.addRecord(name)
+}
+
+// copyFields copies the fields of src into dst with their encodings, only
+// those set in only when it is not nil. The encodings lose their offsets,
+// which belong to src's content.
+func copyFields(dst, src *Record, only map[string]bool) {
+	for _, field := range src.order {
+		if only != nil && !only[field] {
+			continue
+		}
+		value := src.fields[field]
+		if raw, ok := src.raw[field]; ok {
+			dst.setRaw(field, value, rawValue{data: raw.data, offset: -1})
+		} else {
+			dst.update(map[string]interface{}{field: value})
+		}
+	}
+}
+
+// recordDate returns the record's moDD, or failing that modD, in seconds
+// since 1904.
+func recordDate(r *Record) (float64, bool) {
+	if seconds, ok := macDateSeconds(r.fields["moDD"]); ok {
+		return seconds, true
+	}
+	return macDateSeconds(r.fields["modD"])
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// MapDSStore returns a store over the file at path. Memory mapping is only
+// implemented on Unix; elsewhere the file is read into memory and unmap
+// does nothing.
+func MapDSStore(path string) (d *DSStore, unmap func() error, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewDSStore(data), func() error { return nil }, nil
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// MapDSStore maps the file at path into memory read-only and returns a
+// store over the mapping, so a large file is parsed in place instead of
+// being read onto the heap. The store must be parsed and used before
+// calling unmap: byte values of its records point into the mapping. The
+// mapping is read-only, so nothing can modify the file through it; Encode
+// and ReplaceField work on copies.
+func MapDSStore(path string) (d *DSStore, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// Mapping nothing fails; an empty store is just too small.
+		return NewDSStore(nil), func() error { return nil }, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, fmt.Errorf("%s: %d bytes is too large to map", path, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+	return NewDSStore(data), func() error { return syscall.Munmap(data) }, nil
+}
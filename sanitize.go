@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+
+	"howett.net/plist"
+)
+
+// SanitizeFields are the fields Sanitize keeps by default: how the folder
+// is displayed, its view style, window, background and view options, but
+// none of its comments, dates, sizes, icon positions or put-back locations.
+var SanitizeFields = map[string]bool{
+	"BKGD": true,
+	"ICVO": true,
+	"LSVO": true,
+	"bwsp": true,
+	"fwi0": true,
+	"fwsw": true,
+	"fwvh": true,
+	"icvo": true,
+	"icvp": true,
+	"icvt": true,
+	"lsvC": true,
+	"lsvP": true,
+	"lsvo": true,
+	"lsvp": true,
+	"lsvt": true,
+	"vSrn": true,
+	"vstl": true,
+}
+
+// Sanitize returns a new store holding only the fields of d in keep, nil
+// meaning SanitizeFields, for committing a folder's appearance without its
+// contents. Only the "." record, the folder's own settings, is kept unless
+// keepNames is set, since the other records' names list the folder's
+// files. Records left without fields are dropped. Kept fields keep their
+// encodings, except that aliases and bookmarks are removed from property
+// lists: icvp, for one, may include an alias of the background picture
+// naming its path.
+func Sanitize(d *DSStore, keep map[string]bool, keepNames bool) *DSStore {
+	if keep == nil {
+		keep = SanitizeFields
+	}
+	sanitized := NewDSStore(nil)
+	for _, r := range d.records {
+		if !keepNames && !r.IsDirectorySettings() {
+			continue
+		}
+		kept := false
+		for field := range r.fields {
+			kept = kept || keep[field]
+		}
+		if !kept {
+			continue
+		}
+		dst := sanitized.mergedRecord(r.name)
+		copyFields(dst, r, keep)
+		for _, field := range dst.order {
+			b, ok := dst.plistData(field)
+			if !ok {
+				continue
+			}
+			if stripped, changed := stripAliases(b); changed {
+				dst.update(map[string]interface{}{field: stripped})
+			}
+		}
+	}
+	return sanitized
+}
+
+// stripAliases re-encodes a property list dictionary, in its own format,
+// without the top-level keys holding an alias or bookmark, such as icvp's
+// backgroundImageAlias. changed is false when there were none, or data is
+// not a dictionary.
+func stripAliases(data []byte) (stripped []byte, changed bool) {
+	var dict map[string]interface{}
+	format, err := plist.Unmarshal(data, &dict)
+	if err != nil {
+		return data, false
+	}
+	for key := range dict {
+		if strings.HasSuffix(key, "Alias") || strings.HasSuffix(key, "Bookmark") {
+			delete(dict, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return data, false
+	}
+	stripped, err = plist.Marshal(dict, format)
+	if err != nil {
+		return data, false
+	}
+	return stripped, true
+}
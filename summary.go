@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// writeStoreSummary prints an overview of ds: how many records it holds,
+// how many look like folders, and how many records carry each field code,
+// most common first.
+func writeStoreSummary(w io.Writer, ds *DSStore) {
+	counts := make(map[string]int)
+	for code, names := range ds.GroupByField() {
+		counts[code] = len(names)
+	}
+	folders, files := 0, 0
+	for _, r := range ds.readRecords() {
+		switch {
+		case r.name == ".":
+		case r.LooksLikeDirectory():
+			folders++
+		default:
+			files++
+		}
+	}
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if counts[codes[i]] != counts[codes[j]] {
+			return counts[codes[i]] > counts[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+
+	fmt.Fprintf(w, "Records: %d (%d folders, %d files", len(ds.readRecords()), folders, files)
+	if folders+files < len(ds.readRecords()) {
+		fmt.Fprint(w, ", plus the directory's own settings")
+	}
+	fmt.Fprintln(w, ")")
+	fmt.Fprintln(w, "Fields:")
+	for _, code := range codes {
+		fmt.Fprintf(w, "\t%s\t%d\n", code, counts[code])
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// templateRecord is what a --template is executed with, once per record.
+type templateRecord struct {
+	Source string
+	Name   string
+	// Fields holds every field by code, with embedded plists decoded as
+	// Record.Decode does.
+	Fields map[string]interface{}
+}
+
+// templateFuncs are the helpers available to --template on top of the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	"hex":      templateHex,
+	"date":     templateDate,
+	"humanize": humanizeBytes,
+}
+
+// parseTemplate parses a --template argument with templateFuncs available.
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("record").Funcs(templateFuncs).Parse(text)
+}
+
+// writeTemplate executes tmpl for every record of ds, ending each record's
+// output with a newline.
+func writeTemplate(w io.Writer, source string, ds *DSStore, tmpl *template.Template) error {
+	for _, r := range ds.readRecords() {
+		fields := make(map[string]interface{}, len(r.fields))
+		for field := range r.fields {
+			fields[field] = r.Decode(field)
+		}
+		if err := tmpl.Execute(w, templateRecord{Source: source, Name: r.name, Fields: fields}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateHex renders bytes and strings as lowercase hex digits and
+// integers in base 16.
+func templateHex(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return hex.EncodeToString(v)
+	case string:
+		return hex.EncodeToString([]byte(v))
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%x", v)
+	}
+}
+
+// templateDate formats a Mac timestamp field (dutc, moDD, modD) with a Go
+// time layout, e.g. {{.Fields.moDD | date "2006-01-02"}}. Values that are
+// not timestamps give "".
+func templateDate(layout string, v interface{}) string {
+	seconds, ok := macDateSeconds(v)
+	if !ok {
+		return ""
+	}
+	return macEpochTime(seconds).Format(layout)
+}
+
+// humanizeBytes renders a byte count with decimal units as Finder does,
+// e.g. 1532 as "1.5 KB". Non-numeric values give "".
+func humanizeBytes(v interface{}) string {
+	var n float64
+	switch v := v.(type) {
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	case float64:
+		n = v
+	default:
+		return ""
+	}
+	if n < 1000 && n > -1000 {
+		return fmt.Sprintf("%d bytes", int64(n))
+	}
+	for _, unit := range []string{"KB", "MB", "GB", "TB"} {
+		n /= 1000
+		if n < 1000 && n > -1000 || unit == "TB" {
+			return fmt.Sprintf("%.1f %s", n, unit)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeNode is one path in a directory tree reconstructed from stores.
+type TreeNode struct {
+	Name     string      `json:"name"`
+	Dir      bool        `json:"dir"`
+	Children []*TreeNode `json:"children,omitempty"`
+
+	index map[string]*TreeNode
+}
+
+func (n *TreeNode) child(name string) *TreeNode {
+	if c, ok := n.index[name]; ok {
+		return c
+	}
+	if n.index == nil {
+		n.index = make(map[string]*TreeNode)
+	}
+	c := &TreeNode{Name: name}
+	n.index[name] = c
+	n.Children = append(n.Children, c)
+	n.Dir = true
+	return c
+}
+
+func (n *TreeNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
+
+// ReconstructTree merges the filenames listed by several stores into one
+// tree. stores maps the directory each store was found in to the parsed
+// store; since a store lists its own directory's children, every record
+// becomes a child of that directory. An entry is marked as a directory when
+// it has its own store or LooksLikeDirectory says so.
+func ReconstructTree(stores map[string]*DSStore) *TreeNode {
+	root := &TreeNode{Name: ".", Dir: true}
+	dirs := make([]string, 0, len(stores))
+	for dir := range stores {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		node := root
+		clean := path.Clean(filepath.ToSlash(dir))
+		if strings.HasPrefix(clean, "/") {
+			root.Name = "/"
+		}
+		for _, part := range strings.Split(strings.Trim(clean, "/"), "/") {
+			if part != "" && part != "." {
+				node = node.child(part)
+			}
+		}
+		node.Dir = true
+		for _, r := range stores[dir].records {
+			if r.name == "." {
+				continue
+			}
+			c := node.child(r.name)
+			if r.LooksLikeDirectory() {
+				c.Dir = true
+			}
+		}
+	}
+	root.sort()
+	return root
+}
+
+// writeTreeListing prints the tree as a listing indented with
+// render.indent, one entry per line, with directories marked by a trailing
+// slash.
+func writeTreeListing(w io.Writer, n *TreeNode) {
+	var walk func(n *TreeNode, depth int)
+	walk = func(n *TreeNode, depth int) {
+		name := n.Name
+		if n.Dir && name != "/" {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat(render.indent, depth), name)
+		for _, c := range n.Children {
+			walk(c, depth+1)
+		}
+	}
+	walk(n, 0)
+}
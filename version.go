@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// versionString describes this build using the module version and VCS
+// revision recorded by the Go toolchain.
+func versionString() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "ds-store-parser (unknown version)"
+	}
+	version := info.Main.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "-dirty"
+			}
+		}
+	}
+	if revision == "" {
+		return fmt.Sprintf("ds-store-parser %s", version)
+	}
+	return fmt.Sprintf("ds-store-parser %s (%s%s)", version, revision, modified)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// ViewSettings gathers the fields of a folder's record that describe how
+// Finder displays it. Each group of fields has a Has flag telling whether
+// the record stored it, or is nil when absent; absent groups are left zero. In JSON the window and
+// background groups are encoded separately, as WindowInfo and Background,
+// and the Has flags are implied by which keys are present.
+type ViewSettings struct {
+	// Style is the view style from vstl or, when vstl is absent, the one
+	// recorded in fwi0, which vstl overrides.
+	Style    ViewStyle `json:"style,omitempty"`
+	HasStyle bool      `json:"-"`
+
+	// Version is vSrn, whose meaning is not known, or nil without one. It
+	// is a pointer so that a stored 0 is still encoded in JSON.
+	Version *int `json:"version,omitempty"`
+
+	// Window is the fwi0 window rectangle in screen coordinates, with Min
+	// at its top left. It may be negative on secondary displays.
+	Window         image.Rectangle `json:"-"`
+	ToolbarVisible bool            `json:"-"`
+	HasWindow      bool            `json:"-"`
+
+	// IconSize, ArrangeBy and LabelPosition are the icon view options of
+	// icvo. ArrangeBy and LabelPosition are the raw codes, see ArrangeModes
+	// and LabelPositions; only the newer icv4 layout stores a label
+	// position.
+	IconSize      int    `json:"iconSize,omitempty"`
+	ArrangeBy     string `json:"arrangeBy,omitempty"`
+	LabelPosition string `json:"labelPosition,omitempty"`
+	HasIconView   bool   `json:"-"`
+
+	// ListViewOptions holds the lsvo bytes as stored; their layout is not
+	// known.
+	ListViewOptions []byte `json:"listViewOptions,omitempty"`
+	HasListView     bool   `json:"-"`
+
+	// Background is the BKGD type code, see BackgroundTypes, and
+	// BackgroundColor its 16-bit red, green and blue for "ClrB".
+	Background      string    `json:"-"`
+	BackgroundColor [3]uint16 `json:"-"`
+	HasBackground   bool      `json:"-"`
+}
+
+// ViewSettings collects the record's vstl, vSrn, fwi0, icvo and lsvo fields
+// into one value. Fields too short or of the wrong type are treated as
+// absent.
+func (r *Record) ViewSettings() ViewSettings {
+	var v ViewSettings
+	if b, ok := r.fields["fwi0"].([]byte); ok && len(b) >= 16 {
+		top := int(int16(binary.BigEndian.Uint16(b[0:2])))
+		left := int(int16(binary.BigEndian.Uint16(b[2:4])))
+		bottom := int(int16(binary.BigEndian.Uint16(b[4:6])))
+		right := int(int16(binary.BigEndian.Uint16(b[6:8])))
+		v.Window = image.Rectangle{Min: image.Pt(left, top), Max: image.Pt(right, bottom)}
+		v.ToolbarVisible = b[13]&0x01 != 0
+		v.HasWindow = true
+		v.Style, v.HasStyle = ViewStyle(b[8:12]), true
+	}
+	if s, ok := r.fields["vstl"].(string); ok {
+		v.Style, v.HasStyle = ViewStyle(s), true
+	}
+	if n, ok := r.fields["vSrn"].(int); ok {
+		v.Version = &n
+	}
+	if b, ok := r.fields["icvo"].([]byte); ok && len(b) >= 4 {
+		switch {
+		case string(b[0:4]) == "icvo" && len(b) == 18:
+			v.IconSize = int(int16(binary.BigEndian.Uint16(b[12:14])))
+			v.ArrangeBy = string(b[14:18])
+			v.HasIconView = true
+		case string(b[0:4]) == "icv4" && len(b) == 26:
+			v.IconSize = int(int16(binary.BigEndian.Uint16(b[4:6])))
+			v.ArrangeBy = string(b[6:10])
+			v.LabelPosition = string(b[10:14])
+			v.HasIconView = true
+		}
+	}
+	if b, ok := r.fields["lsvo"].([]byte); ok {
+		v.ListViewOptions, v.HasListView = b, true
+	}
+	if b, ok := r.fields["BKGD"].([]byte); ok && len(b) >= 12 {
+		v.Background, v.HasBackground = string(b[0:4]), true
+		if v.Background == "ClrB" {
+			for i := range v.BackgroundColor {
+				v.BackgroundColor[i] = binary.BigEndian.Uint16(b[4+2*i:])
+			}
+		}
+	}
+	return v
+}
+
+// settingsPlists are the plist fields ExportSettings carries over decoded,
+// by the key it files them under. Modern Finder keeps most view settings in
+// them rather than in the binary fields.
+var settingsPlists = map[string]string{
+	"bwsp": "browserWindowSettings",
+	"icvp": "iconViewProperties",
+	"lsvp": "listViewProperties",
+	"lsvP": "listViewPropertiesAlt",
+}
+
+// ExportSettings returns the Finder appearance recorded in the store, keyed
+// by record name, as a plain document of maps, strings, numbers, booleans and
+// bytes that encodes as JSON or a property list. Each record's entry
+// holds its view style, icon view options, background, window bounds and
+// the decoded view plists; records with none of them are left out. The
+// result is meant to be enough to reapply the same appearance elsewhere.
+//
+// A picture background carries the pict alias as "picture" bytes, or
+// "pictureMissing" when the record has none. The alias, like the one in
+// iconViewProperties, locates the picture on the machine that wrote the
+// store and may not resolve on another.
+func (d *DSStore) ExportSettings() map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, r := range d.records {
+		v := r.ViewSettings()
+		s := make(map[string]interface{})
+		if v.HasStyle {
+			s["viewStyle"] = string(v.Style)
+		}
+		if v.HasIconView {
+			s["iconSize"] = v.IconSize
+			s["arrangeBy"] = v.ArrangeBy
+			if v.LabelPosition != "" {
+				s["labelPosition"] = v.LabelPosition
+			}
+		}
+		if v.HasBackground {
+			bg := map[string]interface{}{"type": v.Background}
+			switch v.Background {
+			case "ClrB":
+				c := v.BackgroundColor
+				bg["color"] = fmt.Sprintf("#%04x%04x%04x", c[0], c[1], c[2])
+			case "PctB":
+				if pict, ok := r.fields["pict"].([]byte); ok {
+					bg["picture"] = append([]byte(nil), pict...)
+				} else {
+					bg["pictureMissing"] = true
+				}
+			}
+			s["background"] = bg
+		}
+		if v.HasWindow {
+			s["window"] = map[string]interface{}{
+				"left":           v.Window.Min.X,
+				"top":            v.Window.Min.Y,
+				"right":          v.Window.Max.X,
+				"bottom":         v.Window.Max.Y,
+				"toolbarVisible": v.ToolbarVisible,
+			}
+		}
+		for field, key := range settingsPlists {
+			if _, ok := r.plistData(field); ok {
+				s[key] = r.Decode(field)
+			}
+		}
+		if len(s) > 0 {
+			out[r.name] = s
+		}
+	}
+	return out
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Warning is a non-fatal problem noticed while parsing or decoding a store.
+type Warning struct {
+	// Code is a short, stable identifier such as "bad-length".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Offset is the position in the parsed content the warning refers to,
+	// or -1 when it is not tied to one (e.g. field decoding).
+	Offset int `json:"offset"`
+	// Record and Field name what was being decoded when the warning was
+	// raised, if anything.
+	Record string `json:"record,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+// WarningSink receives every warning raised while parsing and rendering.
+type WarningSink interface {
+	Warn(w Warning)
+}
+
+// stderrSink prints warnings the way the Python parser does.
+type stderrSink struct {
+	// w is where warnings go, os.Stderr when nil.
+	w     io.Writer
+	color bool
+}
+
+func (s stderrSink) Warn(w Warning) {
+	prefix := "Warning:"
+	if s.color {
+		prefix = colorize(sgrYellow, prefix)
+	}
+	out := s.w
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, prefix, w.Message)
+}
+
+// warningCollector keeps warnings in memory, e.g. to attach them to
+// structured output.
+type warningCollector struct {
+	warnings []Warning
+}
+
+func (c *warningCollector) Warn(w Warning) {
+	c.warnings = append(c.warnings, w)
+}
+
+// discardSink drops every warning.
+type discardSink struct{}
+
+func (discardSink) Warn(Warning) {}
+
+var warningSink WarningSink = stderrSink{}
+
+// warnMu serializes calls into sinks, so one sink can take the warnings of
+// a Stream's parse and of the records being decoded meanwhile.
+var warnMu sync.Mutex
+
+// SetWarningSink routes subsequent warnings to sink and returns the
+// previous sink so callers can restore it. Stores with their own
+// WarningSink keep using that while parsing. It must not be called while
+// a Stream is running.
+func SetWarningSink(sink WarningSink) WarningSink {
+	previous := warningSink
+	warningSink = sink
+	return previous
+}
+
+// warningScope is the record and field a warning is about.
+type warningScope struct {
+	record, field string
+}
+
+// warnScope is the record and field currently being decoded, which warn
+// attaches to every warning. Parsing keeps a scope per store instead, see
+// DSStore.warn, so a Stream's parse does not share it with decoding.
+var warnScope warningScope
+
+// scopeWarnings attributes warnings to field of record until the returned
+// function restores the previous scope.
+func scopeWarnings(record, field string) (restore func()) {
+	previous := warnScope
+	warnScope = warningScope{record, field}
+	return func() { warnScope = previous }
+}
+
+// warn reports a problem through the current warning sink.
+func warn(code string, offset int, msg string) {
+	emit(warningSink, Warning{Code: code, Message: msg, Offset: offset, Record: warnScope.record, Field: warnScope.field})
+}
+
+// emit hands w to sink, one warning at a time.
+func emit(sink WarningSink, w Warning) {
+	warnMu.Lock()
+	defer warnMu.Unlock()
+	sink.Warn(w)
+}
+
+// warn reports a problem found while parsing d, attributed to d's own
+// scope, through d.WarningSink or failing that the current warning sink.
+func (d *DSStore) warn(code string, offset int, msg string) {
+	sink := d.WarningSink
+	if sink == nil {
+		sink = warningSink
+	}
+	emit(sink, Warning{Code: code, Message: msg, Offset: offset, Record: d.scope.record, Field: d.scope.field})
+}
+
+// scopeWarnings attributes d's parse warnings to field of record until the
+// returned function restores the previous scope.
+func (d *DSStore) scopeWarnings(record, field string) (restore func()) {
+	previous := d.scope
+	d.scope = warningScope{record, field}
+	return func() { d.scope = previous }
+}
+
+// unrecognizedCodes are the warnings raised when a field, value or data type
+// falls outside what the decoder understands.
+var unrecognizedCodes = map[string]bool{
+	"unrecognized-field": true,
+	"unknown-background": true,
+	"unknown-icvo-type":  true,
+	"unknown-type":       true,
+	"unknown-view-style": true,
+}
+
+// strictOnlyCodes are the unrecognizedCodes only reported under --strict.
+// The text output already marks such a field or view style
+// "(unrecognized)", so warning about it too would be noise on every run.
+var strictOnlyCodes = map[string]bool{
+	"unrecognized-field": true,
+	"unknown-view-style": true,
+}
+
+// quietSink drops the warnings whose codes are in codes and forwards the
+// rest.
+type quietSink struct {
+	next  WarningSink
+	codes map[string]bool
+}
+
+func (s quietSink) Warn(w Warning) {
+	if !s.codes[w.Code] {
+		s.next.Warn(w)
+	}
+}
+
+// strictSink forwards warnings and counts the unrecognized ones, which
+// --strict turns into a failure.
+type strictSink struct {
+	next         WarningSink
+	unrecognized int
+}
+
+func (s *strictSink) Warn(w Warning) {
+	if unrecognizedCodes[w.Code] {
+		s.unrecognized++
+	}
+	s.next.Warn(w)
+}
+
+// err is the --strict failure for filename, if any unrecognized warnings
+// were counted. s may be nil when --strict is off.
+func (s *strictSink) err(filename string) error {
+	if s == nil || s.unrecognized == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %d unrecognized fields or values (--strict)", filename, s.unrecognized)
+}
+
+// anomalySink forwards warnings and remembers which records raised any,
+// for --only-anomalies. A warning about the store itself, such as trailing
+// data or a damaged freelist, raised outside any record, makes every record
+// anomalous.
+type anomalySink struct {
+	next    WarningSink
+	records map[string]bool
+	store   bool
+}
+
+func (s *anomalySink) Warn(w Warning) {
+	if w.Record == "" {
+		s.store = true
+	} else {
+		if s.records == nil {
+			s.records = make(map[string]bool)
+		}
+		s.records[w.Record] = true
+	}
+	s.next.Warn(w)
+}
+
+// anomalous reports whether the record called name, or the store, raised a
+// warning.
+func (s *anomalySink) anomalous(name string) bool {
+	return s.store || s.records[name]
+}
+
+// dedupeSink forwards each distinct warning at most limit times and counts
+// the repeats it drops, so one recurring problem across a corpus doesn't
+// drown the log. Warnings are told apart by code and message, less any
+// dump of the record they were raised for.
+type dedupeSink struct {
+	next  WarningSink
+	limit int
+	seen  map[string]int
+}
+
+func newDedupeSink(next WarningSink, limit int) *dedupeSink {
+	return &dedupeSink{next: next, limit: limit, seen: make(map[string]int)}
+}
+
+// recordDump matches a record formatted with %v, which lists all of its
+// fields and so differs between records with the same problem.
+var recordDump = regexp.MustCompile(`Record\("(?:[^"\\]|\\.)*", map\[.*?\]\) ?`)
+
+// dedupeKey is the code and message of w with any record dump removed.
+func dedupeKey(w Warning) string {
+	return w.Code + ": " + recordDump.ReplaceAllString(w.Message, "")
+}
+
+func (s *dedupeSink) Warn(w Warning) {
+	key := dedupeKey(w)
+	s.seen[key]++
+	if s.seen[key] <= s.limit {
+		s.next.Warn(w)
+	}
+}
+
+// writeSummary reports how many times each suppressed warning repeated.
+func (s *dedupeSink) writeSummary(w io.Writer) {
+	var keys []string
+	for key, n := range s.seen {
+		if n > s.limit {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "Warning: %q repeated %d more times\n", key, s.seen[key]-s.limit)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"unicode"
+	"unicode/utf16"
+)
+
+// pageSize is the node size Finder targets, as recorded in the master
+// block. Nodes are packed up to it, though one may exceed it to avoid an
+// empty sibling.
+const pageSize = 0x1000
+
+// ReplaceField sets field of the record called name to raw, an encoded
+// value as stored on disk: a four-char data type followed by its payload,
+// e.g. "type" followed by "Nlsv" to set vstl to list view. The record is
+// created if the store has none by that name.
+//
+// A value replaced by one of the same encoded length is overwritten in
+// place when the store is encoded, leaving every other byte of the file
+// as it was. Any other change makes Encode rebuild the tree.
+func (d *DSStore) ReplaceField(name, field string, raw []byte) error {
+	if len(field) != 4 {
+		return fmt.Errorf("field code %q is not four bytes", field)
+	}
+	value, err := decodeRaw(raw)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", name, field, err)
+	}
+	raw = append([]byte(nil), raw...)
+
+	rec := d.record(name)
+	if rec == nil {
+		rec = d.addRecord(name)
+		d.rebuild = true
+	}
+	old, ok := rec.raw[field]
+	if ok && old.offset >= 0 && len(old.data) == len(raw) {
+		d.patches = append(d.patches, rawValue{data: raw, offset: old.offset})
+		rec.setRaw(field, value, rawValue{data: raw, offset: old.offset})
+		return nil
+	}
+	d.rebuild = true
+	rec.setRaw(field, value, rawValue{data: raw, offset: -1})
+	return nil
+}
+
+// decodeRaw parses an encoded value, which must be exactly one data type
+// and payload.
+func decodeRaw(raw []byte) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("truncated value %q", raw)
+		}
+	}()
+	tmp := &DSStore{content: raw}
+	value, err = tmp.parseData()
+	if err != nil {
+		return nil, err
+	}
+	if tmp.cursor != len(raw) {
+		return nil, fmt.Errorf("%d trailing bytes after %s value", len(raw)-tmp.cursor, raw[:4])
+	}
+	return value, nil
+}
+
+// encodeValue encodes a value that has no retained raw encoding. Types
+// that several data types share are written as the most general one:
+// int as long, int64 as comp and string as ustr.
+func encodeValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case bool:
+		b := byte(0)
+		if v {
+			b = 1
+		}
+		return []byte{'b', 'o', 'o', 'l', b}, nil
+	case int:
+		return binary.BigEndian.AppendUint32([]byte("long"), uint32(v)), nil
+	case int64:
+		return binary.BigEndian.AppendUint64([]byte("comp"), uint64(v)), nil
+	case string:
+		units := stringToUTF16(v)
+		b := binary.BigEndian.AppendUint32([]byte("ustr"), uint32(len(units)))
+		for _, u := range units {
+			b = binary.BigEndian.AppendUint16(b, u)
+		}
+		return b, nil
+	case []byte:
+		b := binary.BigEndian.AppendUint32([]byte("blob"), uint32(len(v)))
+		return append(b, v...), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T", value)
+}
+
+// Encode serializes the store. When every change since parsing replaced
+// a value with one of the same length, the result is the parsed content
+// with those values overwritten. Otherwise the record tree, master block
+// and allocator are rebuilt from the records, keeping each untouched
+// field's original encoding.
+func (d *DSStore) Encode() ([]byte, error) {
+	if !d.rebuild && len(d.content) > 0 {
+		out := append([]byte(nil), d.content...)
+		for _, p := range d.patches {
+			copy(out[p.offset:], p.data)
+		}
+		return out, nil
+	}
+	entries, err := d.treeEntries()
+	if err != nil {
+		return nil, err
+	}
+	return d.layout(entries).encode(), nil
+}
+
+// WritePlan describes the store Encode would build from the records,
+// without assembling its bytes.
+type WritePlan struct {
+	// InPlace is set when Encode would patch the parsed content instead,
+	// every change having kept its length. The rest of the plan still
+	// describes a rebuild.
+	InPlace bool
+	// Blocks lists every block in ID order.
+	Blocks []PlannedBlock
+	// Root, Height and Nodes describe the record tree; Entries is the
+	// number of fields it holds.
+	Root    uint32
+	Height  uint32
+	Nodes   int
+	Entries int
+	// Size is the length of the encoded store in bytes.
+	Size int
+	// FreeBlocks counts the allocator's free list entries.
+	FreeBlocks int
+	// Problems notes anything Finder may not cope with, such as a node
+	// larger than a page.
+	Problems []string
+}
+
+// PlannedBlock is one block of a WritePlan.
+type PlannedBlock struct {
+	ID int
+	// Kind is "allocator", "master", "leaf" or "internal".
+	Kind    string
+	Address uint32
+	// Size is the block's allocated size, a power of two, and Used how
+	// many of its bytes hold data.
+	Size uint32
+	Used int
+	// Entries is the number of entries in a tree node.
+	Entries int
+}
+
+// PlanWrite lays the store out as Encode would when rebuilding it and
+// reports the result, to check the tree shape and block sizes without
+// writing anything.
+func (d *DSStore) PlanWrite() (WritePlan, error) {
+	entries, err := d.treeEntries()
+	if err != nil {
+		return WritePlan{}, err
+	}
+	l := d.layout(entries)
+	plan := WritePlan{
+		InPlace: !d.rebuild && len(d.content) > 0,
+		Root:    l.root,
+		Height:  l.height,
+		Nodes:   l.nodes,
+		Entries: len(entries),
+	}
+	end := uint32(0x20)
+	for id, b := range l.blocks {
+		block := PlannedBlock{ID: id, Address: l.addrs[id], Size: l.sizes[id], Used: len(b)}
+		switch {
+		case id == 0:
+			block.Kind = "allocator"
+		case id == 1:
+			block.Kind = "master"
+		case binary.BigEndian.Uint32(b) == 0:
+			block.Kind = "leaf"
+		default:
+			block.Kind = "internal"
+		}
+		if id >= 2 {
+			block.Entries = int(binary.BigEndian.Uint32(b[4:]))
+			if len(b) > pageSize {
+				plan.Problems = append(plan.Problems, fmt.Sprintf("%s node %d holds %d bytes, more than a %d-byte page", block.Kind, id, len(b), pageSize))
+			}
+		}
+		if e := block.Address + block.Size; e > end {
+			end = e
+		}
+		plan.Blocks = append(plan.Blocks, block)
+	}
+	plan.Size = int(end)
+	if l.aligned {
+		plan.Size += 4
+	}
+	for _, bucket := range l.freelist {
+		plan.FreeBlocks += len(bucket)
+	}
+	return plan, nil
+}
+
+// treeEntries encodes every field of every record as a tree entry, in the
+// order the tree keeps them: by filename, then by field code.
+func (d *DSStore) treeEntries() ([][]byte, error) {
+	records := append([]*Record(nil), d.records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return compareNames(records[i].name, records[j].name) < 0
+	})
+	var entries [][]byte
+	for _, r := range records {
+		fields := make([]string, 0, len(r.fields))
+		for field := range r.fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		units := stringToUTF16(r.name)
+		for _, field := range fields {
+			raw, ok := r.raw[field]
+			value := raw.data
+			if !ok {
+				var err error
+				if value, err = encodeValue(r.fields[field]); err != nil {
+					return nil, fmt.Errorf("%s %s: %w", r.name, field, err)
+				}
+			}
+			e := binary.BigEndian.AppendUint32(nil, uint32(len(units)))
+			for _, u := range units {
+				e = binary.BigEndian.AppendUint16(e, u)
+			}
+			e = append(e, field...)
+			entries = append(entries, append(e, value...))
+		}
+	}
+	return entries, nil
+}
+
+// compareNames orders filenames the way the tree does: case-insensitively
+// by UTF-16 code unit. Finder folds case with HFS+ rules, which lowercase
+// mapping matches for the names seen in practice. Units are folded one at
+// a time, like HFS+ does, so lone surrogates kept as WTF-8 sort by value.
+func compareNames(a, b string) int {
+	ua, ub := stringToUTF16(a), stringToUTF16(b)
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ca, cb := lowerUnit(ua[i]), lowerUnit(ub[i]); ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return len(ua) - len(ub)
+}
+
+func lowerUnit(u uint16) uint16 {
+	if utf16.IsSurrogate(rune(u)) {
+		return u
+	}
+	return uint16(unicode.ToLower(rune(u)))
+}
+
+// storeLayout is a serialized store before its bytes are assembled: the
+// blocks in ID order, where each lives and the allocator contents.
+type storeLayout struct {
+	// blocks holds block contents by ID: 0 is the allocator, 1 the DSDB
+	// master, then the tree nodes.
+	blocks [][]byte
+	sizes  []uint32
+	addrs  []uint32
+	// freelist holds the free block addresses for each size exponent.
+	freelist [32][]uint32
+	// header is the header's 16 trailing bytes, whose meaning is unknown.
+	header []byte
+	// aligned is set when the output starts with the alignment int.
+	aligned bool
+	// root, height and nodes describe the tree, as the master block does.
+	root, height uint32
+	nodes        int
+}
+
+// layout builds the tree for entries and places every block.
+func (d *DSStore) layout(entries [][]byte) *storeLayout {
+	l := &storeLayout{blocks: [][]byte{nil, nil}, aligned: !d.alignmentAlreadyStripped}
+	if start := int(d.baseOffset) + 16; start+16 <= len(d.content) {
+		l.header = d.content[start : start+16]
+	}
+	l.root, l.height, l.nodes = l.buildTree(entries)
+	master := binary.BigEndian.AppendUint32(nil, l.root)
+	master = binary.BigEndian.AppendUint32(master, l.height)
+	master = binary.BigEndian.AppendUint32(master, uint32(len(entries)))
+	master = binary.BigEndian.AppendUint32(master, uint32(l.nodes))
+	l.blocks[1] = binary.BigEndian.AppendUint32(master, pageSize)
+
+	// The allocator's size depends on the freelist, which depends on where
+	// the blocks, the allocator included, end up. Grow it until it fits.
+	allocSize := uint32(32)
+	for {
+		l.place(allocSize)
+		alloc := l.allocator()
+		if uint32(len(alloc)) <= allocSize {
+			l.blocks[0] = alloc
+			return l
+		}
+		allocSize = blockSize(len(alloc))
+	}
+}
+
+// buildTree adds the nodes of a tree holding entries as blocks, packing
+// each node up to pageSize, and returns the root's ID, the tree's height
+// and its node count.
+func (l *storeLayout) buildTree(entries [][]byte) (root, height uint32, nodes int) {
+	add := func(node []byte) uint32 {
+		l.blocks = append(l.blocks, node)
+		nodes++
+		return uint32(len(l.blocks) - 1)
+	}
+
+	// Leaves: each entry that would overflow the current leaf moves up to
+	// separate it from the next one instead. The last entry always stays
+	// in a leaf so none is left empty.
+	var children []uint32
+	var keys [][]byte
+	var leaf [][]byte
+	size := 8
+	for i, e := range entries {
+		if len(leaf) > 0 && size+len(e) > pageSize && i < len(entries)-1 {
+			children = append(children, add(encodeNode(0, nil, leaf)))
+			keys = append(keys, e)
+			leaf, size = nil, 8
+			continue
+		}
+		leaf = append(leaf, e)
+		size += len(e)
+	}
+	children = append(children, add(encodeNode(0, nil, leaf)))
+
+	// Internal levels, until a single node holds all the keys.
+	for len(children) > 1 {
+		var parents []uint32
+		var promoted [][]byte
+		var nodeChildren []uint32
+		var nodeKeys [][]byte
+		size := 8
+		for i, k := range keys {
+			if len(nodeKeys) > 0 && size+4+len(k) > pageSize && i < len(keys)-1 {
+				parents = append(parents, add(encodeNode(children[i], nodeChildren, nodeKeys)))
+				promoted = append(promoted, k)
+				nodeChildren, nodeKeys, size = nil, nil, 8
+				continue
+			}
+			nodeChildren = append(nodeChildren, children[i])
+			nodeKeys = append(nodeKeys, k)
+			size += 4 + len(k)
+		}
+		parents = append(parents, add(encodeNode(children[len(keys)], nodeChildren, nodeKeys)))
+		children, keys = parents, promoted
+		height++
+	}
+	return children[0], height, nodes
+}
+
+// encodeNode encodes a tree node. A leaf has last 0 and no children; an
+// internal node has a child before each entry and last after them all.
+func encodeNode(last uint32, children []uint32, entries [][]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, last)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+	for i, e := range entries {
+		if children != nil {
+			b = binary.BigEndian.AppendUint32(b, children[i])
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+// blockSize is the smallest power of two block, at least 32 bytes, that
+// holds n bytes.
+func blockSize(n int) uint32 {
+	size := uint32(32)
+	for int(size) < n {
+		size <<= 1
+	}
+	return size
+}
+
+// place assigns each block an address, in ID order after the header and
+// aligned to its size, as the buddy allocator requires, and computes the
+// freelist for the space left over.
+func (l *storeLayout) place(allocSize uint32) {
+	l.sizes = make([]uint32, len(l.blocks))
+	l.addrs = make([]uint32, len(l.blocks))
+	next := uint32(0x20)
+	for i, b := range l.blocks {
+		size := blockSize(len(b))
+		if i == 0 {
+			size = allocSize
+		}
+		next = (next + size - 1) &^ (size - 1)
+		l.sizes[i], l.addrs[i] = size, next
+		next += size
+	}
+	l.freelist = [32][]uint32{}
+	l.free(0, 1<<31)
+}
+
+// free adds the free parts of the buddy block at addr of the given size to
+// the freelist, splitting it around the header and the placed blocks.
+func (l *storeLayout) free(addr, size uint32) {
+	used := addr < 0x20
+	for i := range l.addrs {
+		a, s := l.addrs[i], l.sizes[i]
+		if a == addr && s == size {
+			return
+		}
+		if a < addr+size && addr < a+s {
+			used = true
+		}
+	}
+	if addr == 0 && size == 0x20 {
+		return // the header
+	}
+	if !used {
+		exp := 0
+		for 1<<exp < size {
+			exp++
+		}
+		l.freelist[exp] = append(l.freelist[exp], addr)
+		return
+	}
+	l.free(addr, size/2)
+	l.free(addr+size/2, size/2)
+}
+
+// allocator encodes the allocator block for the current placement.
+func (l *storeLayout) allocator() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(l.blocks)))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	slots := (len(l.blocks) + 255) / 256 * 256
+	for i := 0; i < slots; i++ {
+		var word uint32
+		if i < len(l.blocks) {
+			exp := uint32(0)
+			for 1<<exp < l.sizes[i] {
+				exp++
+			}
+			word = l.addrs[i] | exp
+		}
+		b = binary.BigEndian.AppendUint32(b, word)
+	}
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = append(b, 4)
+	b = append(b, "DSDB"...)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	for _, bucket := range l.freelist {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(bucket)))
+		for _, addr := range bucket {
+			b = binary.BigEndian.AppendUint32(b, addr)
+		}
+	}
+	return b
+}
+
+// encode assembles the header and blocks into the store's bytes.
+func (l *storeLayout) encode() []byte {
+	end := uint32(0x20)
+	for i := range l.blocks {
+		if e := l.addrs[i] + l.sizes[i]; e > end {
+			end = e
+		}
+	}
+	prefix := 0
+	if l.aligned {
+		prefix = 4
+	}
+	out := make([]byte, prefix+int(end))
+	body := out[prefix:]
+	if l.aligned {
+		binary.BigEndian.PutUint32(out, 1)
+	}
+	copy(body, "Bud1")
+	binary.BigEndian.PutUint32(body[4:], l.addrs[0])
+	binary.BigEndian.PutUint32(body[8:], l.sizes[0])
+	binary.BigEndian.PutUint32(body[12:], l.addrs[0])
+	copy(body[16:32], l.header)
+	for i, b := range l.blocks {
+		copy(body[l.addrs[i]:], b)
+	}
+	return out
+}